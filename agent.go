@@ -0,0 +1,160 @@
+package chatglm
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultAgentMaxSteps bound the model calls of Agent.Run when MaxSteps is 0
+const DefaultAgentMaxSteps = 8
+
+// Agent chat with the model and run the tools it calls, feeding their results back
+// as observations, until the model answers without a tool call
+type Agent struct {
+	llm   *Chatglm
+	Tools *ToolRegistry
+	// Executor runs the code of code interpreter calls, they are rejected when it is nil
+	Executor CodeExecutor
+
+	// MaxSteps bound the model calls of one Run, 0 is DefaultAgentMaxSteps
+	MaxSteps int
+	// Approve is asked before every tool call, when it returns an error the tool is not run
+	// and the error is sent to the model instead
+	Approve func(ctx context.Context, call *ToolCallMessage) error
+	// Timeout of a tool call, ToolTimeouts overrides it by tool name, interpreter for code, 0 is no timeout
+	Timeout      time.Duration
+	ToolTimeouts map[string]time.Duration
+	// Options apply to every model call
+	Options []GenerationOption
+}
+
+// AgentStep is a model call of Agent.Run with the tool call it made
+type AgentStep struct {
+	// Reply of the model, with the tool call in ToolCalls
+	Reply *ChatMessage
+	Usage Usage
+	// Observation sent back for the tool call, empty for the answer
+	Observation string
+	// Err of the tool call, rejected or failed calls are reported to the model in Observation
+	Err error
+	// Duration of the tool call
+	Duration time.Duration
+}
+
+// AgentResult is the answer of Agent.Run with the transcript which led to it
+type AgentResult struct {
+	Answer string
+	// Messages are the whole conversation, the messages passed to Run included
+	Messages []*ChatMessage
+	Steps    []AgentStep
+	Usage    Usage
+}
+
+// NewAgent create an agent offering the tools of registry
+func NewAgent(llm *Chatglm, registry *ToolRegistry) *Agent {
+	return &Agent{llm: llm, Tools: registry}
+}
+
+// Run chat by history until the model answers. the tools system prompt is added in front when messages have
+// no system message. ErrMaxSteps is returned together with the transcript when the model keeps calling tools
+func (a *Agent) Run(ctx context.Context, messages []*ChatMessage) (*AgentResult, error) {
+	result := &AgentResult{}
+	if len(messages) > 0 && messages[0].Role != RoleSystem && a.Tools != nil {
+		result.Messages = append(result.Messages, a.Tools.SystemMsg())
+	}
+	result.Messages = append(result.Messages, messages...)
+
+	maxSteps := a.MaxSteps
+	if maxSteps <= 0 {
+		maxSteps = DefaultAgentMaxSteps
+	}
+	for len(result.Steps) < maxSteps {
+		res, err := a.llm.ChatResult(ctx, result.Messages, a.Options...)
+		if err != nil {
+			return result, err
+		}
+		result.Usage.PromptTokens += res.Usage.PromptTokens
+		result.Usage.CompletionTokens += res.Usage.CompletionTokens
+		result.Usage.TotalTokens += res.Usage.TotalTokens
+		result.Messages = append(result.Messages, res.Message)
+		step := AgentStep{Reply: res.Message, Usage: res.Usage}
+
+		if len(res.Message.ToolCalls) == 0 {
+			result.Steps = append(result.Steps, step)
+			result.Answer = res.Text
+			return result, nil
+		}
+
+		start := time.Now()
+		step.Observation, step.Err = a.call(ctx, res.Message.ToolCalls[0])
+		step.Duration = time.Since(start)
+		if ctx.Err() != nil {
+			return result, cancelledError(ctx)
+		}
+		if step.Err != nil {
+			step.Observation = "Error: " + step.Err.Error()
+		}
+		result.Steps = append(result.Steps, step)
+		result.Messages = append(result.Messages, NewObservationMsg(step.Observation))
+	}
+	return result, fmt.Errorf("%w: %d", ErrMaxSteps, maxSteps)
+}
+
+// call approve and run a tool call within its timeout, the handler keeps running
+// in the background when it ignores the cancellation of its context
+func (a *Agent) call(ctx context.Context, call *ToolCallMessage) (string, error) {
+	if a.Approve != nil {
+		if err := a.Approve(ctx, call); err != nil {
+			return "", fmt.Errorf("%w: %w", ErrToolRejected, err)
+		}
+	}
+	var name string
+	var run func(ctx context.Context) (string, error)
+	switch {
+	case call.Type == TypeFunction && call.Function != nil && a.Tools != nil:
+		name = call.Function.Name
+		run = func(ctx context.Context) (string, error) {
+			return a.Tools.Call(ctx, call.Function)
+		}
+	case call.Type == TypeCode && call.Code != nil && a.Executor != nil:
+		name = "interpreter"
+		run = func(ctx context.Context) (string, error) {
+			result, err := a.Executor.Execute(ctx, codeBlock(call.Code.Input))
+			if err != nil {
+				return "", err
+			}
+			return result.Observation(), nil
+		}
+	case call.Type == TypeFunction && call.Function != nil:
+		return "", fmt.Errorf("%w: %s", ErrUnknownTool, call.Function.Name)
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnknownTool, call.Type)
+	}
+
+	timeout := a.Timeout
+	if t, ok := a.ToolTimeouts[name]; ok {
+		timeout = t
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	type output struct {
+		text string
+		err  error
+	}
+	done := make(chan output, 1)
+	go func() {
+		text, err := run(ctx)
+		done <- output{text, err}
+	}()
+	select {
+	case out := <-done:
+		return out.text, out.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("tool %s: %w", name, ctx.Err())
+	}
+}
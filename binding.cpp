@@ -11,7 +11,14 @@
 #include <cstring>
 #include <fstream>
 #include <algorithm>
+#include <chrono>
+#include <random>
+#include <numeric>
+#include <unordered_map>
 #include <signal.h>
+#include <climits>
+#include <atomic>
+#include <type_traits>
 
 #if defined (__unix__) || (defined (__APPLE__) && defined (__MACH__))
 #include <unistd.h>
@@ -32,146 +39,1245 @@ void sigint_handler(int signo) {
 }
 #endif
 
+// LiveObject counts the binding objects which are alive, a member of every object the binding
+// allocates per call, live_objects() lets the leak test check that each call released them
+struct LiveObject {
+    static std::atomic<int> count;
+    LiveObject() { ++count; }
+    LiveObject(const LiveObject &) { ++count; }
+    LiveObject &operator=(const LiveObject &) = default;
+    ~LiveObject() { --count; }
+};
+
+std::atomic<int> LiveObject::count{0};
+
+int live_objects() {
+    return LiveObject::count.load();
+}
+
 // stream for callback go function, copy from chatglm::TextStreamer
 class TextBindStreamer : public chatglm::BaseStreamer {
 public:
-    TextBindStreamer(chatglm::BaseTokenizer *tokenizer, void* draft_pipe)
-            : draft_pipe(draft_pipe), tokenizer_(tokenizer), is_prompt_(true), print_len_(0) {}
+    TextBindStreamer(chatglm::BaseTokenizer *tokenizer, uintptr_t handle,
+                     const std::vector<std::string> &stop_sequences = {})
+            : handle_(handle), tokenizer_(tokenizer), is_prompt_(true), print_len_(0),
+              stop_sequences_(stop_sequences) {}
     void put(const std::vector<int> &output_ids) override;
     void end() override;
+    // go callback returned false, generation should stop
+    bool is_stopped() const { return is_stopped_; }
 
 private:
-    void* draft_pipe;
+    // pass text to go, holding back what may still become a stop sequence
+    bool send(const std::string &text, bool flush);
+
+    uintptr_t handle_;
     chatglm::BaseTokenizer *tokenizer_;
     bool is_prompt_;
+    bool is_stopped_ = false;
     std::vector<int> token_cache_;
+    // ids put since the last go callback
+    std::vector<int> pending_ids_;
     int print_len_;
+    std::vector<std::string> stop_sequences_;
+    // printable text which is not sent because it may start a stop sequence
+    std::string held_text_;
+    // a stop sequence was streamed up to its start, nothing after it is sent
+    bool stop_matched_ = false;
+    LiveObject live_;
+};
+
+// chatglm::GenerationConfig with the options which the binding implements itself
+struct BindGenerationConfig : public chatglm::GenerationConfig {
+    LiveObject live;
+    std::vector<std::string> stop_sequences;
+    // seed of the sampler, negative draws a fresh seed for every request
+    int64_t seed = -1;
+    // samplers and penalties which chatglm.cpp does not have, the defaults disable them
+    float min_p = 0.f;
+    float typical_p = 1.f;
+    float presence_penalty = 0.f;
+    float frequency_penalty = 0.f;
+    // presence and frequency penalties count the last penalty_window generated tokens, 0 counts all of them
+    int penalty_window = 0;
+    int no_repeat_ngram_size = 0;
+    // added to the logits before sampling, banned tokens have a bias of -inf
+    std::unordered_map<int, float> logit_bias;
+    // a token is never sampled when the output would contain one of them
+    std::vector<std::string> banned_strings;
+    // report log-probabilities of generated tokens and this many alternatives to go, 0 disables it
+    int logprobs = 0;
+    // number of completions to return and to generate, go keeps the n most likely of best_of
+    int n = 1;
+    int best_of = 0;
+    // beam search replaces sampling when num_beams > 1
+    int num_beams = 1;
+    float length_penalty = 1.f;
+    bool early_stopping = false;
+    // ask go which tokens the grammar of the request allows before sampling
+    bool grammar = false;
+};
+
+// prompt and generation do not fit in max_length
+class ContextOverflowError : public std::runtime_error {
+public:
+    using std::runtime_error::runtime_error;
 };
 
-std::vector<chatglm::ChatMessage> create_chat_message_vector(void** history, int count) {
-    std::vector<chatglm::ChatMessage>* vec = new std::vector<chatglm::ChatMessage>;
+// run f and convert exceptions into error codes, the message is copied into err and freed by go
+template <typename F>
+int catch_error(char** err, F f) {
+    try {
+        return f();
+    } catch (const ContextOverflowError &e) {
+        *err = strdup(e.what());
+        return GENERATE_CONTEXT_OVERFLOW;
+    } catch (const std::exception &e) {
+        *err = strdup(e.what());
+        return GENERATE_ERROR;
+    }
+}
+
+// chat messages copied from go
+struct ChatMessages {
+    std::vector<chatglm::ChatMessage> messages;
+    LiveObject live;
+};
+
+// copy go messages into chatglm::ChatMessage, the go side still owns and frees messages
+ChatMessages create_chat_message_vector(const chat_message* messages, int count) {
+    ChatMessages result;
+    std::vector<chatglm::ChatMessage> &vec = result.messages;
+    vec.reserve(count);
     for (int i = 0; i < count; i++) {
-        chatglm::ChatMessage* msg = (chatglm::ChatMessage*) history[i];
-        vec->push_back(*msg);
+        std::vector<chatglm::ToolCallMessage> tool_calls;
+        for (int j = 0; j < messages[i].tool_calls_count; j++) {
+            const tool_call_message &tool_call = messages[i].tool_calls[j];
+            if (tool_call.type == chatglm::ToolCallMessage::TYPE_FUNCTION) {
+                tool_calls.emplace_back(chatglm::FunctionMessage(tool_call.name, tool_call.arguments));
+            } else if (tool_call.type == chatglm::ToolCallMessage::TYPE_CODE) {
+                tool_calls.emplace_back(chatglm::CodeMessage(tool_call.code));
+            }
+        }
+        vec.emplace_back(messages[i].role, messages[i].content, tool_calls);
     }
 
-    return *vec;
+    return result;
 }
 
-std::vector<chatglm::ToolCallMessage> create_tool_call_vector(void** tool_calls, int count) {
-    std::vector<chatglm::ToolCallMessage>* vec = new std::vector<chatglm::ToolCallMessage>;
-    for (int i = 0; i < count; i++) {
-        chatglm::ToolCallMessage* msg = (chatglm::ToolCallMessage*) tool_calls[i];
-        vec->push_back(*msg);
+// sentencepiece model of tokenizer, nullptr when tokenizer is not a Tokenizer
+template <typename Tokenizer>
+const sentencepiece::SentencePieceProcessor* tokenizer_sp(const chatglm::BaseTokenizer* tokenizer) {
+    auto t = dynamic_cast<const Tokenizer*>(tokenizer);
+    return t == nullptr ? nullptr : &t->sp;
+}
+
+const sentencepiece::SentencePieceProcessor* tokenizer_sentencepiece(const chatglm::BaseTokenizer* tokenizer) {
+    for (auto get_sp : {tokenizer_sp<chatglm::ChatGLMTokenizer>, tokenizer_sp<chatglm::ChatGLM2Tokenizer>,
+                        tokenizer_sp<chatglm::ChatGLM3Tokenizer>, tokenizer_sp<chatglm::BaichuanTokenizer>,
+                        tokenizer_sp<chatglm::InternLMTokenizer>}) {
+        const sentencepiece::SentencePieceProcessor* sp = get_sp(tokenizer);
+        if (sp != nullptr) {
+            return sp;
+        }
+    }
+    throw std::runtime_error("unknown tokenizer");
+}
+
+// piece of a token id, including special tokens outside the sentencepiece vocabulary
+std::string id_to_piece(const chatglm::BaseTokenizer* tokenizer, int id) {
+    auto chatglm3 = dynamic_cast<const chatglm::ChatGLM3Tokenizer*>(tokenizer);
+    if (chatglm3 != nullptr) {
+        auto pos = chatglm3->index_special_tokens.find(id);
+        if (pos != chatglm3->index_special_tokens.end()) {
+            return pos->second;
+        }
+    }
+    auto chatglm2 = dynamic_cast<const chatglm::ChatGLM2Tokenizer*>(tokenizer);
+    if (chatglm2 != nullptr) {
+        const std::vector<std::pair<int, std::string>> special_tokens{
+                {chatglm2->mask_token_id, "[MASK]"}, {chatglm2->gmask_token_id, "[gMASK]"},
+                {chatglm2->smask_token_id, "[sMASK]"}, {chatglm2->sop_token_id, "sop"},
+                {chatglm2->eop_token_id, "eop"}};
+        for (const auto &special_token : special_tokens) {
+            if (special_token.first == id) {
+                return special_token.second;
+            }
+        }
     }
 
-    return *vec;
+    const sentencepiece::SentencePieceProcessor* sp = tokenizer_sentencepiece(tokenizer);
+    if (id < 0 || id >= sp->GetPieceSize()) {
+        throw std::runtime_error("token id " + std::to_string(id) + " is out of vocabulary");
+    }
+    return sp->IdToPiece(id);
 }
 
-std::string decode_with_special_tokens(chatglm::ChatGLM3Tokenizer* tokenizer, const std::vector<int> &ids) {
+std::string decode_with_special_tokens(const chatglm::BaseTokenizer* tokenizer, const std::vector<int> &ids) {
     std::vector<std::string> pieces;
     for (int id : ids) {
-        auto pos = tokenizer->index_special_tokens.find(id);
-        if (pos != tokenizer->index_special_tokens.end()) {
-            // special tokens
-            pieces.emplace_back(pos->second);
+        pieces.emplace_back(id_to_piece(tokenizer, id));
+    }
+
+    std::string text = tokenizer_sentencepiece(tokenizer)->DecodePieces(pieces);
+    return text;
+}
+
+// bytes which id adds to the output, with sentencepiece's \u2581 as space and byte pieces like <0x0A>
+// decoded, false for special tokens
+bool token_text(const chatglm::BaseTokenizer* tokenizer, int id, std::string* text) {
+    const sentencepiece::SentencePieceProcessor* sp = tokenizer_sentencepiece(tokenizer);
+    if (id < 0 || id >= sp->GetPieceSize() || sp->IsControl(id) || sp->IsUnknown(id)) {
+        return false;
+    }
+    std::string piece = sp->IdToPiece(id);
+    if (sp->IsByte(id)) {
+        *text = std::string(1, (char) std::stoi(piece.substr(3, 2), nullptr, 16));
+        return true;
+    }
+
+    static const std::string space_marker = "\xe2\x96\x81";
+    text->clear();
+    for (size_t i = 0; i < piece.size();) {
+        if (piece.compare(i, space_marker.size(), space_marker) == 0) {
+            *text += ' ';
+            i += space_marker.size();
         } else {
-            // normal tokens
-            pieces.emplace_back(tokenizer->sp.IdToPiece(id));
+            *text += piece[i++];
         }
     }
+    return true;
+}
 
-    std::string text = tokenizer->sp.DecodePieces(pieces);
-    return text;
+// text of generated ids with special tokens skipped by id. For ChatGLM3 an <|assistant|> token inside the
+// reply separates the content from a code interpreter call, it becomes DELIMITER of options.go
+std::string decode_output(const chatglm::BaseTokenizer* tokenizer, const std::vector<int> &ids) {
+    const chatglm::ChatGLM3Tokenizer* chatglm3 = dynamic_cast<const chatglm::ChatGLM3Tokenizer*>(tokenizer);
+    std::string out;
+    std::vector<int> run;
+    std::string text;
+    for (size_t i = 0; i < ids.size(); i++) {
+        int id = ids[i];
+        if (token_text(tokenizer, id, &text)) {
+            run.emplace_back(id);
+            continue;
+        }
+        if (!run.empty()) {
+            out += tokenizer->decode(run);
+            run.clear();
+        }
+        if (chatglm3 != nullptr && id == chatglm3->assistant_token_id && i + 1 < ids.size()) {
+            out += "<|delimiter|>";
+        }
+    }
+    if (!run.empty()) {
+        out += tokenizer->decode(run);
+    }
+    return out;
+}
+
+// copy s into malloc memory which go frees
+char* copy_string(const std::string &s, int* length) {
+    char* out = (char*) malloc(s.size() + 1);
+    memcpy(out, s.data(), s.size());
+    out[s.size()] = '\0';
+    *length = s.size();
+    return out;
 }
 
-void* load_model(const char *name) {
-    return new chatglm::Pipeline(name);
+// model_context reaches chatglm::BaseModelForCausalLM::ctx_, which chatglm.cpp keeps protected and
+// which forward_logits, embed and score need to build their own graphs.
+//
+// This is pinned to the chatglm.cpp v0.3 model layout: ctx_ is a chatglm::ModelContext with the
+// ctx_b, gf, compute_buffer and work_buffer members used below. An explicit template instantiation
+// may name a protected member, so ProtectedMember captures &BaseModelForCausalLM::ctx_ and exposes it
+// through the friend get. When the submodule is updated the static_asserts fail with a message naming
+// what changed, instead of an error deep inside the instantiation; port model_context and graph_compute
+// to the new layout, or switch to an accessor if upstream adds one.
+template <typename Tag, auto Member>
+struct ProtectedMember {
+    static_assert(std::is_same_v<decltype(Member), typename Tag::type>,
+                  "chatglm::BaseModelForCausalLM::ctx_ is no longer a chatglm::ModelContext, "
+                  "model_context must be ported to the new chatglm.cpp");
+    friend typename Tag::type get(Tag) { return Member; }
+};
+
+struct ModelContextTag {
+    typedef chatglm::ModelContext chatglm::BaseModelForCausalLM::*type;
+    friend type get(ModelContextTag);
+};
+
+template struct ProtectedMember<ModelContextTag, &chatglm::BaseModelForCausalLM::ctx_>;
+
+static_assert(std::is_same_v<decltype(chatglm::ModelContext::ctx_b), chatglm::unique_ggml_context_t>,
+              "chatglm::ModelContext::ctx_b changed, graph building must be ported to the new chatglm.cpp");
+static_assert(std::is_same_v<decltype(chatglm::ModelContext::gf), ggml_cgraph>,
+              "chatglm::ModelContext::gf changed, graph_compute must be ported to the new chatglm.cpp");
+
+chatglm::ModelContext &model_context(chatglm::BaseModelForCausalLM* model) {
+    return model->*get(ModelContextTag());
+}
+
+// copy from ggml_graph_compute_helper in chatglm.cpp
+void graph_compute(chatglm::ModelContext &ctx, int n_threads) {
+#ifdef GGML_USE_METAL
+    ggml_metal_graph_compute(ctx.ctx_metal.get(), &ctx.gf);
+#else
+    if (n_threads <= 0) {
+        n_threads = chatglm::get_default_num_threads();
+    }
+    struct ggml_cplan plan = ggml_graph_plan(&ctx.gf, n_threads);
+    if (plan.work_size > 0) {
+        ctx.work_buffer.resize(plan.work_size);
+        plan.work_data = (uint8_t*) ctx.work_buffer.data();
+    }
+    ggml_graph_compute(&ctx.gf, &plan);
+#endif
+}
+
+// final hidden states of the transformer, nullptr when model is not a BasicModelForCausalLM<Model>
+template <typename Model>
+ggml_tensor* forward_transformer(chatglm::BaseModelForCausalLM* model, chatglm::ModelContext* ctx,
+                                 ggml_tensor* input_ids) {
+    auto causal_lm = dynamic_cast<chatglm::BasicModelForCausalLM<Model>*>(model);
+    if (causal_lm == nullptr) {
+        return nullptr;
+    }
+    return causal_lm->transformer.forward(ctx, input_ids, 0, input_ids->ne[0]);
+}
+
+// run the transformer over ids, return hidden states of every token, row major [ids.size(), hidden_size]
+std::vector<float> hidden_states(chatglm::Pipeline* pipe_p, const std::vector<int> &ids, int num_threads) {
+    chatglm::BaseModelForCausalLM* model = pipe_p->model.get();
+    chatglm::ModelContext &ctx = model_context(model);
+    ctx.ctx_b = chatglm::make_unique_ggml_context(ctx.compute_buffer.size(), ctx.compute_buffer.data(), false);
+    ctx.gf = {};
+
+    ggml_tensor* input_ids = ggml_new_tensor_1d(ctx.ctx_b.get(), GGML_TYPE_I32, ids.size());
+    memcpy(input_ids->data, ids.data(), ggml_nbytes(input_ids));
+
+    ggml_tensor* hidden = nullptr;
+    for (auto forward : {forward_transformer<chatglm::ChatGLMModel>, forward_transformer<chatglm::ChatGLM2Model>,
+                         forward_transformer<chatglm::Baichuan7BModel>, forward_transformer<chatglm::Baichuan13BModel>,
+                         forward_transformer<chatglm::InternLM7BModel>, forward_transformer<chatglm::InternLM20BModel>}) {
+        if ((hidden = forward(model, &ctx, input_ids)) != nullptr) {
+            break;
+        }
+    }
+    if (hidden == nullptr) {
+        throw std::runtime_error("hidden states are not supported for model type " +
+                                 chatglm::to_string(model->config.model_type));
+    }
+    hidden->backend = GGML_BACKEND_CPU;
+
+    ggml_build_forward_expand(&ctx.gf, hidden);
+    graph_compute(ctx, num_threads);
+
+    const float* data = (const float*) hidden->data;
+    return std::vector<float>(data, data + ids.size() * model->config.hidden_size);
+}
+
+// copy from chatglm::BaseModelForCausalLM::generate_next_token, forward ids[n_past, end) with ids[0, n_past)
+// already in the kv cache, return the logits of the last token when is_decoding, otherwise the logits
+// of every token, row major [end - n_past, vocab_size]
+std::vector<float> forward_logits(chatglm::BaseModelForCausalLM* model, const std::vector<int> &ids, int n_past,
+                                  int end, int n_ctx, int num_threads, bool is_decoding) {
+    chatglm::ModelContext &ctx = model_context(model);
+    ctx.ctx_b = chatglm::make_unique_ggml_context(ctx.compute_buffer.size(), ctx.compute_buffer.data(), false);
+    ctx.gf = {};
+
+    int n_threads = num_threads; // user defined
+    if (n_threads <= 0) {
+        n_threads = chatglm::get_default_num_threads(); // default thread num
+    }
+    int curr_input_ids_size = end - n_past;
+    if (curr_input_ids_size >= 32 && ggml_cpu_has_blas() && !ggml_cpu_has_gpublas()) {
+        n_threads = 1; // use 1 thread if BLAS is enabled
+    }
+
+    ggml_tensor* curr_input_ids = ggml_new_tensor_1d(ctx.ctx_b.get(), GGML_TYPE_I32, curr_input_ids_size);
+    memcpy(curr_input_ids->data, ids.data() + n_past, ggml_nbytes(curr_input_ids));
+
+    ggml_tensor* lm_logits = model->forward(&ctx, curr_input_ids, n_past, n_ctx, is_decoding);
+    lm_logits->backend = GGML_BACKEND_CPU;
+
+    ggml_build_forward_expand(&ctx.gf, lm_logits);
+    graph_compute(ctx, n_threads);
+
+    const float* data = (const float*) lm_logits->data;
+    return std::vector<float>(data, data + lm_logits->ne[0] * (is_decoding ? 1 : curr_input_ids_size));
+}
+
+// logits of the token after input_ids, the binding samples from them with its own rng
+std::vector<float> next_token_logits(chatglm::BaseModelForCausalLM* model, const std::vector<int> &input_ids,
+                                     const chatglm::GenerationConfig &gen_config, int n_past, int n_ctx) {
+    return forward_logits(model, input_ids, n_past, input_ids.size(), n_ctx, gen_config.num_threads, true);
+}
+
+// log(sum(exp(x))) of the logits, stable for large logits
+float log_sum_exp(const float* first, const float* last) {
+    const float max_logit = *std::max_element(first, last);
+    double sum = 0;
+    for (const float* p = first; p != last; p++) {
+        sum += std::exp(*p - max_logit);
+    }
+    return max_logit + std::log(sum);
 }
 
-int chat(void* pipe_pr, void** history, int history_count, void* params_ptr, char* result) {
-    std::vector<chatglm::ChatMessage> vectors = create_chat_message_vector(history, history_count);
+// openai style penalties, subtract frequency_penalty for every occurrence of a token in the window
+// and presence_penalty once for every token which occurs
+void sampling_presence_frequency_penalty(float* first, float* last, const std::vector<int> &window,
+                                         float presence_penalty, float frequency_penalty) {
+    std::unordered_map<int, int> counts;
+    for (int id : window) {
+        counts[id]++;
+    }
+    for (const auto &count : counts) {
+        if (count.first < 0 || count.first >= last - first) {
+            continue;
+        }
+        first[count.first] -= count.second * frequency_penalty + presence_penalty;
+    }
+}
+
+// ban every token which would repeat an ngram of size n in ids, like no_repeat_ngram_size of transformers
+void sampling_no_repeat_ngram(float* first, float* last, const std::vector<int> &ids, int n) {
+    if ((int) ids.size() < n - 1) {
+        return;
+    }
+    const int prefix_start = ids.size() - (n - 1);
+    for (int i = 0; i + n <= (int) ids.size(); i++) {
+        if (std::equal(ids.begin() + i, ids.begin() + i + n - 1, ids.begin() + prefix_start)) {
+            int banned = ids[i + n - 1];
+            if (banned >= 0 && banned < last - first) {
+                first[banned] = -INFINITY;
+            }
+        }
+    }
+}
+
+// keep the tokens whose probability is at least min_p times the probability of the most likely one,
+// compared as logits so no softmax is needed
+void sampling_min_p(std::vector<chatglm::TokenIdScore> &token_scores, float min_p) {
+    float max_score = std::max_element(token_scores.begin(), token_scores.end())->score;
+    float threshold = max_score + std::log(min_p);
+    token_scores.erase(std::remove_if(token_scores.begin(), token_scores.end(),
+                                      [threshold](const chatglm::TokenIdScore &ts) { return ts.score < threshold; }),
+                       token_scores.end());
+}
+
+// locally typical sampling, keep the tokens whose information content is closest to the entropy
+// until their probabilities sum up to typical_p
+void sampling_typical(std::vector<chatglm::TokenIdScore> &token_scores, float typical_p) {
+    std::vector<chatglm::TokenIdScore> probs = token_scores;
+    chatglm::BaseModelForCausalLM::sampling_softmax_inplace(probs.data(), probs.data() + probs.size());
+
+    float entropy = 0.f;
+    for (const auto &p : probs) {
+        if (p.score > 0.f) {
+            entropy -= p.score * std::log(p.score);
+        }
+    }
+
+    std::vector<size_t> order(probs.size());
+    for (size_t i = 0; i < order.size(); i++) {
+        order[i] = i;
+    }
+    auto shift = [&](size_t i) { return std::abs(-std::log(probs[i].score) - entropy); };
+    std::sort(order.begin(), order.end(), [&](size_t a, size_t b) { return shift(a) < shift(b); });
+
+    std::vector<chatglm::TokenIdScore> kept;
+    float cum_prob = 0.f;
+    for (size_t i : order) {
+        kept.emplace_back(token_scores[i]);
+        cum_prob += probs[i].score;
+        if (cum_prob >= typical_p) {
+            break;
+        }
+    }
+    token_scores = std::move(kept);
+}
+
+// logit bias and penalties which sampling and beam search share, input_ids holds the prompt_size
+// prompt tokens followed by the generated ones
+void process_logits(std::vector<float> &logits, const std::vector<int> &input_ids, size_t prompt_size,
+                    const BindGenerationConfig &gen_config) {
+    float* next_token_logits = logits.data();
+    const int vocab_size = logits.size();
+
+    // logit bias
+    for (const auto &bias : gen_config.logit_bias) {
+        if (bias.first >= 0 && bias.first < vocab_size) {
+            next_token_logits[bias.first] += bias.second;
+        }
+    }
+
+    // repetition penalty
+    if (gen_config.repetition_penalty != 1.f) {
+        chatglm::BaseModelForCausalLM::sampling_repetition_penalty(next_token_logits, next_token_logits + vocab_size,
+                                                                   input_ids, gen_config.repetition_penalty);
+    }
+
+    // presence and frequency penalty
+    if (gen_config.presence_penalty != 0.f || gen_config.frequency_penalty != 0.f) {
+        auto window_begin = input_ids.begin() + prompt_size;
+        if (gen_config.penalty_window > 0 && input_ids.end() - window_begin > gen_config.penalty_window) {
+            window_begin = input_ids.end() - gen_config.penalty_window;
+        }
+        sampling_presence_frequency_penalty(next_token_logits, next_token_logits + vocab_size,
+                                            std::vector<int>(window_begin, input_ids.end()),
+                                            gen_config.presence_penalty, gen_config.frequency_penalty);
+    }
+
+    // no repeat ngram
+    if (gen_config.no_repeat_ngram_size > 0) {
+        sampling_no_repeat_ngram(next_token_logits, next_token_logits + vocab_size, input_ids,
+                                 gen_config.no_repeat_ngram_size);
+    }
+}
+
+// copy from the sampling part of chatglm::BaseModelForCausalLM::generate_next_token, which draws from
+// a thread local rng seeded by std::random_device, draw from rng instead and add the samplers of
+// BindGenerationConfig
+int sample_token(std::vector<float> &logits, const std::vector<int> &input_ids, size_t prompt_size,
+                 const BindGenerationConfig &gen_config, std::mt19937_64 &rng) {
+    process_logits(logits, input_ids, prompt_size, gen_config);
+    float* next_token_logits = logits.data();
+    const int vocab_size = logits.size();
+
+    if (!gen_config.do_sample) {
+        // greedy search
+        return std::max_element(next_token_logits, next_token_logits + vocab_size) - next_token_logits;
+    }
+
+    // temperature sampling
+    chatglm::BaseModelForCausalLM::sampling_temperature(next_token_logits, next_token_logits + vocab_size,
+                                                        gen_config.temperature);
+
+    std::vector<chatglm::TokenIdScore> token_scores(vocab_size);
+    for (int i = 0; i < vocab_size; i++) {
+        token_scores[i] = {i, next_token_logits[i]};
+    }
+
+    // top_k sampling
+    if (0 < gen_config.top_k && gen_config.top_k < (int) token_scores.size()) {
+        chatglm::BaseModelForCausalLM::sampling_top_k(token_scores.data(), token_scores.data() + gen_config.top_k,
+                                                      token_scores.data() + token_scores.size());
+        token_scores.resize(gen_config.top_k);
+    }
+
+    // typical sampling
+    if (0.f < gen_config.typical_p && gen_config.typical_p < 1.f) {
+        sampling_typical(token_scores, gen_config.typical_p);
+    }
+
+    // min_p sampling
+    if (0.f < gen_config.min_p && gen_config.min_p <= 1.f) {
+        sampling_min_p(token_scores, gen_config.min_p);
+    }
+
+    // top_p sampling
+    if (0.f < gen_config.top_p && gen_config.top_p < 1.f) {
+        auto pos = chatglm::BaseModelForCausalLM::sampling_top_p(token_scores.data(),
+                                                                 token_scores.data() + token_scores.size(),
+                                                                 gen_config.top_p);
+        token_scores.resize(pos - token_scores.data());
+    }
+
+    // sample next token
+    chatglm::BaseModelForCausalLM::sampling_softmax_inplace(token_scores.data(),
+                                                            token_scores.data() + token_scores.size());
+    for (size_t i = 0; i < token_scores.size(); i++) {
+        next_token_logits[i] = token_scores[i].score;
+    }
+
+    std::discrete_distribution<> dist(next_token_logits, next_token_logits + token_scores.size());
+    return token_scores[dist(rng)].id;
+}
+
+// whether the generated ids followed by id contain one of the banned strings, special tokens included
+bool spells_banned_string(const chatglm::BaseTokenizer* tokenizer, std::vector<int> generated_ids, int id,
+                          const std::vector<std::string> &banned_strings) {
+    generated_ids.emplace_back(id);
+    std::string text = decode_with_special_tokens(tokenizer, generated_ids);
+    for (const std::string &banned : banned_strings) {
+        if (!banned.empty() && text.find(banned) != std::string::npos) {
+            return true;
+        }
+    }
+    return false;
+}
+
+// sample a token, sample again without it as long as it completes one of the banned strings
+int sample_allowed_token(const chatglm::BaseTokenizer* tokenizer, std::vector<float> logits,
+                         const std::vector<int> &input_ids, size_t prompt_size,
+                         const BindGenerationConfig &gen_config, std::mt19937_64 &rng) {
+    const std::vector<int> generated_ids(input_ids.begin() + prompt_size, input_ids.end());
+    for (size_t attempt = 0; attempt < logits.size(); attempt++) {
+        // sample_token modifies the logits in place
+        std::vector<float> candidate_logits = logits;
+        int id = sample_token(candidate_logits, input_ids, prompt_size, gen_config, rng);
+        if (gen_config.banned_strings.empty() ||
+            !spells_banned_string(tokenizer, generated_ids, id, gen_config.banned_strings)) {
+            return id;
+        }
+        logits[id] = -INFINITY;
+    }
+    throw std::runtime_error("every token leads to a banned string");
+}
+
+bool is_eos_token(const chatglm::BaseModelForCausalLM* model, int id) {
+    return id == model->config.eos_token_id ||
+           std::find(model->config.extra_eos_token_ids.begin(), model->config.extra_eos_token_ids.end(), id) !=
+                   model->config.extra_eos_token_ids.end();
+}
+
+// log softmax of the logits of the model, hand the sampled token and the n most likely tokens to go
+void report_logprobs(uintptr_t handle, int index, const chatglm::BaseTokenizer* tokenizer,
+                     const std::vector<float> &logits, int token_id, int n) {
+    const float log_sum = log_sum_exp(logits.data(), logits.data() + logits.size());
+
+    n = std::min<int>(n, logits.size());
+    std::vector<int> top_ids(logits.size());
+    std::iota(top_ids.begin(), top_ids.end(), 0);
+    std::partial_sort(top_ids.begin(), top_ids.begin() + n, top_ids.end(),
+                      [&logits](int a, int b) { return logits[a] > logits[b]; });
+    top_ids.resize(n);
+
+    std::vector<std::string> top_pieces;
+    std::vector<float> top_logprobs;
+    for (int id : top_ids) {
+        top_pieces.emplace_back(id_to_piece(tokenizer, id));
+        top_logprobs.emplace_back(logits[id] - log_sum);
+    }
+    std::vector<char*> top_pieces_p;
+    for (std::string &piece : top_pieces) {
+        top_pieces_p.emplace_back(piece.data());
+    }
+
+    std::string piece = id_to_piece(tokenizer, token_id);
+    // callback go function
+    logprobCallback(handle, index, token_id, piece.data(), logits[token_id] - log_sum, top_ids.data(), top_pieces_p.data(),
+                    top_logprobs.data(), n);
+}
+
+// tokens forwarded at once while scoring, bounds the memory of the logits of every token
+static const int SCORE_BATCH_SIZE = 128;
+
+// log-likelihood of every token given the tokens before it, the first token has no context and scores 0.
+// ids are evaluated in windows of window_size tokens which start every stride tokens, every token is scored
+// once in the first window which contains it with context, like the perplexity of transformers
+std::vector<float> score_ids(chatglm::Pipeline* pipe_p, const std::vector<int> &ids, int window_size, int stride,
+                             int num_threads) {
+    chatglm::BaseModelForCausalLM* model = pipe_p->model.get();
+    const int n = ids.size();
+    if (window_size <= 0 || window_size > n) {
+        window_size = n;
+    }
+    if (stride <= 0 || stride > window_size) {
+        stride = window_size;
+    }
+    if (window_size > model->config.max_length) {
+        throw ContextOverflowError("window of " + std::to_string(window_size) +
+                                   " tokens is larger than model's max_length (" +
+                                   std::to_string(model->config.max_length) + ")");
+    }
+
+    std::vector<float> logprobs(n, 0.f);
+    // tokens before prev_end are scored
+    int prev_end = 1;
+    for (int begin = 0; prev_end < n; begin += stride) {
+        const int end = std::min(begin + window_size, n);
+        const std::vector<int> window(ids.begin() + begin, ids.begin() + end);
+        for (int n_past = 0; n_past < (int) window.size(); n_past += SCORE_BATCH_SIZE) {
+            const int batch_end = std::min<int>(n_past + SCORE_BATCH_SIZE, window.size());
+            std::vector<float> logits = forward_logits(model, window, n_past, batch_end, window.size(),
+                                                       num_threads, false);
+            const int vocab_size = logits.size() / (batch_end - n_past);
+            // the logits at position p predict the token at p + 1
+            for (int p = n_past; p < batch_end && p + 1 < (int) window.size(); p++) {
+                const int target = begin + p + 1;
+                if (target < prev_end) {
+                    continue;
+                }
+                const float* row = logits.data() + (p - n_past) * vocab_size;
+                logprobs[target] = row[ids[target]] - log_sum_exp(row, row + vocab_size);
+            }
+        }
+        prev_end = end;
+    }
+    return logprobs;
+}
+
+// mask the tokens which the grammar of the go request does not allow after last_token, -1 starts the
+// index-th candidate, eos tokens are allowed once the grammar is complete
+void apply_grammar(uintptr_t handle, int index, const chatglm::BaseModelForCausalLM* model, int last_token,
+                   std::vector<float> &logits) {
+    std::vector<unsigned char> allowed(logits.size(), 0);
+    // callback go function
+    bool complete = grammarCallback(handle, index, last_token, allowed.data(), allowed.size());
+    bool any = false;
+    for (size_t id = 0; id < logits.size(); id++) {
+        if (is_eos_token(model, id) ? complete : allowed[id]) {
+            any = true;
+        } else {
+            logits[id] = -INFINITY;
+        }
+    }
+    if (!any) {
+        throw std::runtime_error("grammar allows no token after the output");
+    }
+}
+
+// throw ContextOverflowError when the prompt and generation can not fit in max_length
+void check_context(const chatglm::BaseModelForCausalLM* model, const std::vector<int> &input_ids,
+                   const chatglm::GenerationConfig &gen_config) {
+    if (gen_config.max_length > model->config.max_length) {
+        throw ContextOverflowError("requested max_length (" + std::to_string(gen_config.max_length) +
+                                   ") is larger than model's max_length (" +
+                                   std::to_string(model->config.max_length) + ")");
+    }
+    if ((int)input_ids.size() >= gen_config.max_length) {
+        throw ContextOverflowError("prompt of " + std::to_string(input_ids.size()) +
+                                   " tokens leaves no room for generation within max_length (" +
+                                   std::to_string(gen_config.max_length) + ")");
+    }
+}
+
+// copy from chatglm::BaseModelForCausalLM::generate, but ask go before every token whether the request
+// has been cancelled and stop once the stream callback returns false, report finish reason and usage of
+// the index-th candidate to go at the end, return only the new output ids like chatglm::Pipeline::generate.
+// prompt_logits keeps the logits after the prompt, once it is filled the prompt is taken from the kv cache
+std::vector<int> generate_ids(chatglm::Pipeline* pipe_p, uintptr_t handle, int index, const std::vector<int> &input_ids,
+                              const BindGenerationConfig &gen_config, TextBindStreamer *streamer,
+                              std::vector<float> &prompt_logits, std::mt19937_64 &rng, int* status) {
+    chatglm::BaseModelForCausalLM* model = pipe_p->model.get();
+    check_context(model, input_ids, gen_config);
+
+    std::vector<int> output_ids;
+    output_ids.reserve(gen_config.max_length);
+    output_ids = input_ids;
+    if (streamer) {
+        streamer->put(input_ids);
+    }
+
+    int n_past = 0;
+    const int n_ctx = input_ids.size();
+    int finish_reason = FINISH_LENGTH;
+    int stop_index = -1;
+    // the first forward pass evaluates the prompt, the rest generate one token each
+    double prompt_ms = 0, completion_ms = 0;
+    // log-probability of the output under the model
+    double cumulative_logprob = 0;
+
+    while ((int)output_ids.size() < gen_config.max_length) {
+        // callback go function
+        if (cancelCallback(handle)) {
+            *status = GENERATE_CANCELLED;
+            finish_reason = FINISH_CANCELLED;
+            break;
+        }
+
+        auto start = std::chrono::steady_clock::now();
+        std::vector<float> logits;
+        if (n_past == 0 && !prompt_logits.empty()) {
+            logits = prompt_logits;
+        } else {
+            logits = next_token_logits(model, output_ids, gen_config, n_past, n_ctx);
+            if (n_past == 0) {
+                prompt_logits = logits;
+            }
+        }
+        std::vector<float> allowed_logits = logits;
+        if (gen_config.grammar) {
+            apply_grammar(handle, index, model, n_past == 0 ? -1 : output_ids.back(), allowed_logits);
+        }
+        int next_token_id = sample_allowed_token(pipe_p->tokenizer.get(), std::move(allowed_logits), output_ids,
+                                                 input_ids.size(), gen_config, rng);
+        double elapsed_ms = std::chrono::duration<double, std::milli>(std::chrono::steady_clock::now() - start).count();
+        if (n_past == 0) {
+            prompt_ms = elapsed_ms;
+        } else {
+            completion_ms += elapsed_ms;
+        }
+
+        cumulative_logprob += logits[next_token_id] - log_sum_exp(logits.data(), logits.data() + logits.size());
+        if (gen_config.logprobs > 0 && !is_eos_token(model, next_token_id)) {
+            report_logprobs(handle, index, pipe_p->tokenizer.get(), logits, next_token_id, gen_config.logprobs);
+        }
+
+        n_past = output_ids.size();
+        output_ids.emplace_back(next_token_id);
+
+        if (streamer) {
+            streamer->put({next_token_id});
+            if (streamer->is_stopped()) {
+                *status = GENERATE_STOPPED;
+                finish_reason = FINISH_CALLBACK;
+                break;
+            }
+        }
+
+        if (is_eos_token(model, next_token_id)) {
+            finish_reason = FINISH_STOP;
+            break;
+        }
+
+        // decode the whole output, a stop sequence may span several tokens
+        if (!gen_config.stop_sequences.empty()) {
+            std::string text = pipe_p->tokenizer->decode(
+                    std::vector<int>(output_ids.begin() + input_ids.size(), output_ids.end()));
+            for (size_t i = 0; i < gen_config.stop_sequences.size(); i++) {
+                const std::string &stop = gen_config.stop_sequences[i];
+                if (!stop.empty() && text.find(stop) != std::string::npos) {
+                    stop_index = i;
+                    break;
+                }
+            }
+            if (stop_index >= 0) {
+                finish_reason = FINISH_STOP_SEQUENCE;
+                break;
+            }
+        }
+    }
+
+    if (streamer) {
+        streamer->end();
+    }
+    // callback go function
+    finishCallback(handle, index, finish_reason, stop_index, input_ids.size(), output_ids.size() - input_ids.size(),
+                   prompt_ms, completion_ms, cumulative_logprob);
+
+    return std::vector<int>(output_ids.begin() + input_ids.size(), output_ids.end());
+}
+
+// kv cache shared by several sequences, keeps which ids it holds so that the longest common prefix
+// with the next sequence is not evaluated again
+class PrefixCache {
+public:
+    // logits of the token after ids
+    std::vector<float> logits(chatglm::BaseModelForCausalLM* model, const std::vector<int> &ids, int n_ctx,
+                              int num_threads) {
+        // evaluate at least the last token
+        size_t n_past = 0;
+        while (n_past < cached_ids_.size() && n_past + 1 < ids.size() && cached_ids_[n_past] == ids[n_past]) {
+            n_past++;
+        }
+        std::vector<float> logits = forward_logits(model, ids, n_past, ids.size(), n_ctx, num_threads, true);
+        cached_ids_ = ids;
+        return logits;
+    }
+
+private:
+    std::vector<int> cached_ids_;
+};
+
+// a beam of beam search, ids are the generated tokens, eos included
+struct BeamHypothesis {
+    std::vector<int> ids;
+    // sum of the log-probabilities of ids
+    double logprob = 0;
+    int finish_reason = FINISH_LENGTH;
+};
+
+// length normalised score of transformers, length_penalty > 0 favours longer outputs
+double beam_score(const BeamHypothesis &beam, float length_penalty) {
+    return beam.logprob / std::pow(std::max<size_t>(beam.ids.size(), 1), length_penalty);
+}
+
+// beam search like generate of transformers over the logits which sampling uses, the finished beams are
+// reported to go best first as candidates with their score, the streamer gets the best beam at the end.
+// stop sequences and banned strings are not applied to beams
+std::vector<std::vector<int>> beam_search(chatglm::Pipeline* pipe_p, uintptr_t handle,
+                                          const std::vector<int> &input_ids, const BindGenerationConfig &gen_config,
+                                          TextBindStreamer *streamer, int* status) {
+    chatglm::BaseModelForCausalLM* model = pipe_p->model.get();
+    check_context(model, input_ids, gen_config);
+
+    const size_t num_beams = gen_config.num_beams;
+    const float length_penalty = gen_config.length_penalty;
+    auto better = [length_penalty](const BeamHypothesis &a, const BeamHypothesis &b) {
+        return beam_score(a, length_penalty) > beam_score(b, length_penalty);
+    };
+
+    PrefixCache cache;
+    double prompt_ms = 0, completion_ms = 0;
+    std::vector<BeamHypothesis> beams(1), finished;
+    while (!beams.empty()) {
+        // callback go function
+        if (cancelCallback(handle)) {
+            *status = GENERATE_CANCELLED;
+            for (BeamHypothesis &beam : beams) {
+                beam.finish_reason = FINISH_CANCELLED;
+                finished.emplace_back(beam);
+            }
+            break;
+        }
+        // live beams are always of the same length
+        const size_t cur_len = beams[0].ids.size();
+        if ((int) (input_ids.size() + cur_len) >= gen_config.max_length) {
+            finished.insert(finished.end(), beams.begin(), beams.end());
+            break;
+        }
+
+        struct Candidate {
+            size_t beam;
+            int id;
+            double logprob;
+        };
+        std::vector<Candidate> candidates;
+        for (size_t b = 0; b < beams.size(); b++) {
+            std::vector<int> ids = input_ids;
+            ids.insert(ids.end(), beams[b].ids.begin(), beams[b].ids.end());
+
+            auto start = std::chrono::steady_clock::now();
+            std::vector<float> logits = cache.logits(model, ids, input_ids.size(), gen_config.num_threads);
+            double elapsed_ms = std::chrono::duration<double, std::milli>(std::chrono::steady_clock::now() - start).count();
+            if (cur_len == 0) {
+                prompt_ms += elapsed_ms;
+            } else {
+                completion_ms += elapsed_ms;
+            }
+
+            process_logits(logits, ids, input_ids.size(), gen_config);
+            const float log_sum = log_sum_exp(logits.data(), logits.data() + logits.size());
+            // 2 * num_beams tokens per beam leave num_beams candidates even when all beams end with eos
+            const size_t top_k = std::min(2 * num_beams, logits.size());
+            std::vector<int> top_ids(logits.size());
+            std::iota(top_ids.begin(), top_ids.end(), 0);
+            std::partial_sort(top_ids.begin(), top_ids.begin() + top_k, top_ids.end(),
+                              [&logits](int a, int c) { return logits[a] > logits[c]; });
+            for (size_t i = 0; i < top_k; i++) {
+                candidates.push_back({b, top_ids[i], beams[b].logprob + logits[top_ids[i]] - log_sum});
+            }
+        }
+        std::sort(candidates.begin(), candidates.end(),
+                  [](const Candidate &a, const Candidate &b) { return a.logprob > b.logprob; });
+
+        std::vector<BeamHypothesis> next_beams;
+        for (size_t rank = 0; rank < candidates.size() && next_beams.size() < num_beams; rank++) {
+            const Candidate &candidate = candidates[rank];
+            BeamHypothesis beam = beams[candidate.beam];
+            beam.ids.emplace_back(candidate.id);
+            beam.logprob = candidate.logprob;
+            if (!is_eos_token(model, candidate.id)) {
+                next_beams.emplace_back(std::move(beam));
+            } else if (rank < num_beams) {
+                beam.finish_reason = FINISH_STOP;
+                finished.emplace_back(std::move(beam));
+            }
+        }
+        beams = std::move(next_beams);
+
+        if (finished.size() >= num_beams) {
+            std::sort(finished.begin(), finished.end(), better);
+            finished.resize(num_beams);
+            if (gen_config.early_stopping || beams.empty()) {
+                break;
+            }
+            // no live beam can beat the worst finished one anymore
+            if (beam_score(beams[0], length_penalty) <= beam_score(finished.back(), length_penalty)) {
+                break;
+            }
+        }
+    }
+
+    std::sort(finished.begin(), finished.end(), better);
+    if (finished.size() > num_beams) {
+        finished.resize(num_beams);
+    }
+
+    if (streamer) {
+        streamer->put(input_ids);
+        if (!finished.empty()) {
+            streamer->put(finished[0].ids);
+        }
+        streamer->end();
+    }
+
+    std::vector<std::vector<int>> outputs;
+    for (size_t i = 0; i < finished.size(); i++) {
+        // callback go function, the timings belong to the best beam
+        finishCallback(handle, i, finished[i].finish_reason, -1, input_ids.size(), finished[i].ids.size(),
+                       i == 0 ? prompt_ms : 0, i == 0 ? completion_ms : 0, beam_score(finished[i], length_penalty));
+        outputs.emplace_back(finished[i].ids);
+    }
+    return outputs;
+}
+
+// generate max(n, best_of) candidates, the prompt is evaluated once and its kv cache is shared by every
+// candidate, only the first candidate is streamed. with num_beams the candidates are the beams
+std::vector<std::vector<int>> generate_candidates(chatglm::Pipeline* pipe_p, uintptr_t handle,
+                                                  const std::vector<int> &input_ids,
+                                                  const BindGenerationConfig &gen_config, TextBindStreamer *streamer,
+                                                  int* status) {
+    if (gen_config.num_beams > 1) {
+        return beam_search(pipe_p, handle, input_ids, gen_config, streamer, status);
+    }
+
+    const int count = std::max({1, gen_config.n, gen_config.best_of});
+    // one rng for all candidates, so that they differ under a seed
+    std::mt19937_64 rng(gen_config.seed >= 0 ? (uint64_t) gen_config.seed : std::random_device{}());
+    std::vector<float> prompt_logits;
+
+    std::vector<std::vector<int>> candidates;
+    for (int i = 0; i < count && *status == GENERATE_OK; i++) {
+        candidates.emplace_back(generate_ids(pipe_p, handle, i, input_ids, gen_config, i == 0 ? streamer : nullptr,
+                                             prompt_logits, rng, status));
+    }
+    return candidates;
+}
+
+void* load_model(const char *name, char** err) {
+    try {
+        return new chatglm::Pipeline(name);
+    } catch (const std::exception &e) {
+        *err = strdup(e.what());
+        return nullptr;
+    }
+}
+
+// chat by messages, pass the output of every candidate to go by resultCallback
+int chat_messages(chatglm::Pipeline* pipe_p, uintptr_t handle, const chat_message* messages, int messages_count,
+                  const BindGenerationConfig &params, TextBindStreamer* streamer) {
+    ChatMessages vectors = create_chat_message_vector(messages, messages_count);
+
+    std::vector<int> input_ids = pipe_p->tokenizer->encode_messages(vectors.messages, params.max_context_length);
+    int status = GENERATE_OK;
+    std::vector<std::vector<int>> candidates = generate_candidates(pipe_p, handle, input_ids, params, streamer,
+                                                                   &status);
+    for (size_t i = 0; i < candidates.size(); i++) {
+        std::string out = decode_output(pipe_p->tokenizer.get(), candidates[i]);
+        // callback go function
+        resultCallback(handle, i, out.data(), out.size());
+    }
+
+    return status;
+}
+
+// generate by prompt, pass the output of every candidate to go by resultCallback
+int generate_prompt(chatglm::Pipeline* pipe_p, uintptr_t handle, const char *prompt,
+                    const BindGenerationConfig &params, TextBindStreamer* streamer) {
+    std::vector<int> input_ids = pipe_p->tokenizer->encode(std::string(prompt), params.max_context_length);
+    int status = GENERATE_OK;
+    std::vector<std::vector<int>> candidates = generate_candidates(pipe_p, handle, input_ids, params, streamer,
+                                                                   &status);
+    for (size_t i = 0; i < candidates.size(); i++) {
+        std::string res = pipe_p->tokenizer->decode(candidates[i]);
+        // callback go function
+        resultCallback(handle, i, res.data(), res.size());
+    }
+
+    return status;
+}
+
+int chat(void* pipe_pr, uintptr_t handle, const chat_message* messages, int messages_count, void* params_ptr,
+         char** err) {
     chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
-    chatglm::GenerationConfig* params = (chatglm::GenerationConfig*) params_ptr;
+    BindGenerationConfig* params = (BindGenerationConfig*) params_ptr;
 
-    chatglm::ChatMessage res = pipe_p->chat(vectors, *params);
+    return catch_error(err, [&] {
+        return chat_messages(pipe_p, handle, messages, messages_count, *params, nullptr);
+    });
+}
 
-    std::string out = res.content;
-    // ChatGLM3Tokenizer::decode_message change origin output, convert it to ChatMessage
-    // So we need to convert it back
-    if (pipe_p->model->config.model_type == chatglm::ModelType::CHATGLM3) {
-        std::vector<chatglm::ChatMessage>* resultVec =  new std::vector<chatglm::ChatMessage>{res};
-        chatglm::ChatGLM3Tokenizer* tokenizer = dynamic_cast<chatglm::ChatGLM3Tokenizer*>(pipe_p->tokenizer.get());
-        std::vector<int> input_ids =  tokenizer->encode_messages(*resultVec, params->max_context_length);
-        out = decode_with_special_tokens(tokenizer, input_ids);
+// stop sequences the streamer holds back, beam search does not apply them
+std::vector<std::string> streamed_stop_sequences(const BindGenerationConfig &params) {
+    if (params.num_beams > 1) {
+        return {};
     }
-    strcpy(result, out.c_str());
+    return params.stop_sequences;
+}
+
+int stream_chat(void* pipe_pr, uintptr_t handle, const chat_message* messages, int messages_count, void* params_ptr,
+                char** err) {
+    chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
+    BindGenerationConfig* params = (BindGenerationConfig*) params_ptr;
 
-    vectors.clear();
-    return 0;
+    TextBindStreamer text_stream(pipe_p->tokenizer.get(), handle, streamed_stop_sequences(*params));
+    return catch_error(err, [&] {
+        return chat_messages(pipe_p, handle, messages, messages_count, *params, &text_stream);
+    });
 }
 
-int stream_chat(void* pipe_pr, void** history, int history_count,void* params_ptr, char* result) {
-    std::vector<chatglm::ChatMessage> vectors = create_chat_message_vector(history, history_count);
+int generate(void* pipe_pr, uintptr_t handle, const char *prompt, void* params_ptr, char** err) {
     chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
-    chatglm::GenerationConfig* params = (chatglm::GenerationConfig*) params_ptr;
+    BindGenerationConfig* params = (BindGenerationConfig*) params_ptr;
 
-    TextBindStreamer* text_stream = new TextBindStreamer(pipe_p->tokenizer.get(), pipe_pr);
+    return catch_error(err, [&] {
+        return generate_prompt(pipe_p, handle, prompt, *params, nullptr);
+    });
+}
 
-    chatglm::ChatMessage res = pipe_p->chat(vectors, *params, text_stream);
+int stream_generate(void* pipe_pr, uintptr_t handle, const char *prompt, void* params_ptr, char** err) {
+    chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
+    BindGenerationConfig* params = (BindGenerationConfig*) params_ptr;
 
-    std::string out = res.content;
-    // ChatGLM3Tokenizer::decode_message change origin output, convert it to ChatMessage
-    // So we need to convert it back
-    if (pipe_p->model->config.model_type == chatglm::ModelType::CHATGLM3) {
-        std::vector<chatglm::ChatMessage>* resultVec =  new std::vector<chatglm::ChatMessage>{res};
-        chatglm::ChatGLM3Tokenizer* tokenizer = dynamic_cast<chatglm::ChatGLM3Tokenizer*>(pipe_p->tokenizer.get());
-        std::vector<int> input_ids =  tokenizer->encode_messages(*resultVec, params->max_context_length);
-        out = decode_with_special_tokens(tokenizer, input_ids);
-    }
-    strcpy(result, out.c_str());
+    TextBindStreamer text_stream(pipe_p->tokenizer.get(), handle, streamed_stop_sequences(*params));
+    return catch_error(err, [&] {
+        return generate_prompt(pipe_p, handle, prompt, *params, &text_stream);
+    });
+}
+
+int get_embedding(void* pipe_pr, const char *prompt, int max_length, int * result, char** err) {
+    chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
+
+    return catch_error(err, [&] {
+        std::vector<int> embeddings = pipe_p->tokenizer->encode(prompt, max_length);
 
-    vectors.clear();
-    return 0;
+        for (size_t i = 0; i < embeddings.size(); i++) {
+            result[i]=embeddings[i];
+        }
+
+        return 0;
+    });
 }
 
-int generate(void* pipe_pr, const char *prompt, void* params_ptr, char* result) {
+int get_vocab_size(void* pipe_pr) {
     chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
-    chatglm::GenerationConfig* params = (chatglm::GenerationConfig*) params_ptr;
+    return pipe_p->model->config.vocab_size;
+}
 
-    std::string res = pipe_p->generate(std::string(prompt), *params);
-    strcpy(result, res.c_str());
+int get_hidden_size(void* pipe_pr) {
+    chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
+    return pipe_p->model->config.hidden_size;
+}
+
+int embed(void* pipe_pr, const char *text, int max_length, int pooling, int num_threads, float* result, char** err) {
+    chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
+
+    return catch_error(err, [&] {
+        std::vector<int> ids = pipe_p->tokenizer->encode(text, max_length);
+        if (ids.empty()) {
+            throw std::runtime_error("no tokens to embed");
+        }
+        const int hidden_size = pipe_p->model->config.hidden_size;
+        std::vector<float> states = hidden_states(pipe_p, ids, num_threads);
+
+        std::fill(result, result + hidden_size, 0.f);
+        if (pooling == POOLING_MEAN) {
+            for (size_t i = 0; i < ids.size(); i++) {
+                for (int j = 0; j < hidden_size; j++) {
+                    result[j] += states[i * hidden_size + j] / ids.size();
+                }
+            }
+        } else {
+            size_t row = pooling == POOLING_LAST ? ids.size() - 1 : 0;
+            std::copy(states.begin() + row * hidden_size, states.begin() + (row + 1) * hidden_size, result);
+        }
+        return 0;
+    });
+}
 
-    return 0;
+int score(void* pipe_pr, const int* ids, int count, int window_size, int stride, int num_threads, float* result,
+          char** err) {
+    chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
+
+    return catch_error(err, [&] {
+        std::vector<float> logprobs = score_ids(pipe_p, std::vector<int>(ids, ids + count), window_size, stride,
+                                                num_threads);
+        std::copy(logprobs.begin(), logprobs.end(), result);
+        return 0;
+    });
 }
 
-int stream_generate(void* pipe_pr, const char *prompt, void* params_ptr, char* result) {
+char* vocab_texts(void* pipe_pr, int vocab_size, int* lengths, char** err) {
     chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
-    chatglm::GenerationConfig* params = (chatglm::GenerationConfig*) params_ptr;
 
-    TextBindStreamer* text_stream = new TextBindStreamer(pipe_p->tokenizer.get(), pipe_pr);
+    char* result = nullptr;
+    catch_error(err, [&] {
+        std::string texts;
+        std::string text;
+        for (int id = 0; id < vocab_size; id++) {
+            if (token_text(pipe_p->tokenizer.get(), id, &text)) {
+                texts += text;
+                lengths[id] = text.size();
+            } else {
+                lengths[id] = -1;
+            }
+        }
+        int length;
+        result = copy_string(texts, &length);
+        return 0;
+    });
+    return result;
+}
 
-    std::string res = pipe_p->generate(std::string(prompt), *params, text_stream);
-    strcpy(result, res.c_str());
+int* tokenize(void* pipe_pr, const char *text, int* count, char** err) {
+    chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
 
-    return 0;
+    int* result = nullptr;
+    catch_error(err, [&] {
+        std::vector<int> ids = pipe_p->tokenizer->encode(text, INT_MAX);
+        result = (int*) malloc(std::max<size_t>(ids.size(), 1) * sizeof(int));
+        std::copy(ids.begin(), ids.end(), result);
+        *count = ids.size();
+        return 0;
+    });
+    return result;
 }
 
-int get_embedding(void* pipe_pr, const char *prompt, int max_length, int * result) {
+char* detokenize(void* pipe_pr, const int* ids, int count, int* length, char** err) {
     chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
 
-    std::vector<int> embeddings = pipe_p->tokenizer->encode(prompt, max_length);
+    char* result = nullptr;
+    catch_error(err, [&] {
+        result = copy_string(pipe_p->tokenizer->decode(std::vector<int>(ids, ids + count)), length);
+        return 0;
+    });
+    return result;
+}
 
-    for (size_t i = 0; i < embeddings.size(); i++) {
-        result[i]=embeddings[i];
-    }
+char* token_to_piece(void* pipe_pr, int id, int* length, char** err) {
+    chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
 
-    return 0;
+    char* result = nullptr;
+    catch_error(err, [&] {
+        result = copy_string(id_to_piece(pipe_p->tokenizer.get(), id), length);
+        return 0;
+    });
+    return result;
+}
+
+char* token_pieces(void* pipe_pr, const int* ids, int count, int* lengths, char** err) {
+    chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
+
+    char* result = nullptr;
+    catch_error(err, [&] {
+        std::string pieces;
+        for (int i = 0; i < count; i++) {
+            std::string piece = id_to_piece(pipe_p->tokenizer.get(), ids[i]);
+            pieces += piece;
+            lengths[i] = piece.size();
+        }
+        int length;
+        result = copy_string(pieces, &length);
+        return 0;
+    });
+    return result;
+}
+
+char* render_prompt(void* pipe_pr, const chat_message* messages, int messages_count, int max_context_length,
+                    int* length, int** ids, int* ids_count, char** err) {
+    chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
+
+    char* result = nullptr;
+    catch_error(err, [&] {
+        ChatMessages vectors = create_chat_message_vector(messages, messages_count);
+        std::vector<int> input_ids = pipe_p->tokenizer->encode_messages(vectors.messages, max_context_length);
+
+        result = copy_string(decode_with_special_tokens(pipe_p->tokenizer.get(), input_ids), length);
+        *ids = (int*) malloc(std::max<size_t>(input_ids.size(), 1) * sizeof(int));
+        std::copy(input_ids.begin(), input_ids.end(), *ids);
+        *ids_count = input_ids.size();
+        return 0;
+    });
+    return result;
 }
 
 void* allocate_params(int max_length, int max_context_length, bool do_sample, int top_k,
                       float top_p, float temperature, float repetition_penalty, int num_threads) {
-    chatglm::GenerationConfig* gen_config = new chatglm::GenerationConfig;
+    BindGenerationConfig* gen_config = new BindGenerationConfig;
     gen_config->max_length = max_length;
     gen_config->max_context_length = max_context_length;
     gen_config->do_sample = do_sample;
@@ -183,39 +1289,68 @@ void* allocate_params(int max_length, int max_context_length, bool do_sample, in
     return gen_config;
 }
 
-void free_params(void* params_ptr) {
-    chatglm::GenerationConfig* params = (chatglm::GenerationConfig*) params_ptr;
-    delete params;
+void add_stop_sequence(void* params_ptr, const char* stop) {
+    BindGenerationConfig* params = (BindGenerationConfig*) params_ptr;
+    params->stop_sequences.emplace_back(stop);
 }
 
-void free_model(void* pipe_pr) {
-    chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
-    delete pipe_p;
+void set_seed(void* params_ptr, int64_t seed) {
+    BindGenerationConfig* params = (BindGenerationConfig*) params_ptr;
+    params->seed = seed;
 }
 
-void* create_chat_message(const char* role, const char *content, void** tool_calls, int tool_calls_count) {
-    std::vector<chatglm::ToolCallMessage> vector = create_tool_call_vector(tool_calls, tool_calls_count);
-    return new chatglm::ChatMessage(role, content, vector);
+void set_sampling(void* params_ptr, float min_p, float typical_p, float presence_penalty,
+                  float frequency_penalty, int penalty_window, int no_repeat_ngram_size) {
+    BindGenerationConfig* params = (BindGenerationConfig*) params_ptr;
+    params->min_p = min_p;
+    params->typical_p = typical_p;
+    params->presence_penalty = presence_penalty;
+    params->frequency_penalty = frequency_penalty;
+    params->penalty_window = penalty_window;
+    params->no_repeat_ngram_size = no_repeat_ngram_size;
 }
 
-void* create_tool_call(const char* type, void* codeOrFunc) {
-    if (type == chatglm::ToolCallMessage::TYPE_FUNCTION) {
-        chatglm::FunctionMessage* function_p = (chatglm::FunctionMessage*) codeOrFunc;
-        return new chatglm::ToolCallMessage(*function_p);
-    } else if (type == chatglm::ToolCallMessage::TYPE_CODE) {
-        chatglm::CodeMessage* code_p = (chatglm::CodeMessage*) codeOrFunc;
-        return new chatglm::ToolCallMessage(*code_p);
-    }
-    return nullptr;
+void set_logit_bias(void* params_ptr, int token_id, float bias) {
+    BindGenerationConfig* params = (BindGenerationConfig*) params_ptr;
+    params->logit_bias[token_id] = bias;
+}
+
+void add_banned_string(void* params_ptr, const char* banned) {
+    BindGenerationConfig* params = (BindGenerationConfig*) params_ptr;
+    params->banned_strings.emplace_back(banned);
+}
+
+void set_logprobs(void* params_ptr, int logprobs) {
+    BindGenerationConfig* params = (BindGenerationConfig*) params_ptr;
+    params->logprobs = logprobs;
+}
+
+void set_choices(void* params_ptr, int n, int best_of) {
+    BindGenerationConfig* params = (BindGenerationConfig*) params_ptr;
+    params->n = n;
+    params->best_of = best_of;
 }
 
-void* create_function(const char* name, const char *arguments) {
-    return new chatglm::FunctionMessage(name, arguments);
+void set_beam_search(void* params_ptr, int num_beams, float length_penalty, bool early_stopping) {
+    BindGenerationConfig* params = (BindGenerationConfig*) params_ptr;
+    params->num_beams = num_beams;
+    params->length_penalty = length_penalty;
+    params->early_stopping = early_stopping;
 }
 
+void set_grammar(void* params_ptr, bool grammar) {
+    BindGenerationConfig* params = (BindGenerationConfig*) params_ptr;
+    params->grammar = grammar;
+}
+
+void free_params(void* params_ptr) {
+    BindGenerationConfig* params = (BindGenerationConfig*) params_ptr;
+    delete params;
+}
 
-void* create_code(const char* input) {
-    return  new chatglm::CodeMessage(input);
+void free_model(void* pipe_pr) {
+    chatglm::Pipeline* pipe_p = (chatglm::Pipeline*) pipe_pr;
+    delete pipe_p;
 }
 
 char* get_model_type(void* pipe_pr) {
@@ -236,6 +1371,7 @@ void TextBindStreamer::put(const std::vector<int> &output_ids) {
     static const std::vector<char> puncts{',', '!', ':', ';', '?'};
 
     token_cache_.insert(token_cache_.end(), output_ids.begin(), output_ids.end());
+    pending_ids_.insert(pending_ids_.end(), output_ids.begin(), output_ids.end());
     std::string text = tokenizer_->decode(token_cache_);
     if (text.empty()) {
         return;
@@ -257,22 +1393,60 @@ void TextBindStreamer::put(const std::vector<int> &output_ids) {
         print_len_ = text.size();
     }
 
-    // callback go function
-    if (!streamCallback(draft_pipe, printable_text.data())) {
-        return;
+    if (!send(printable_text, false)) {
+        is_stopped_ = true;
     }
 }
 
 // copy from chatglm::TextStreamer
 void TextBindStreamer::end() {
     std::string text = tokenizer_->decode(token_cache_);
-    // callback go function
-    if (!streamCallback(draft_pipe, text.substr(print_len_).data())) {
-        return;
-    }
+    // generation is already over so the result of the go callback does not matter
+    send(text.substr(print_len_), true);
     is_prompt_ = true;
     token_cache_.clear();
+    pending_ids_.clear();
     print_len_ = 0;
+    held_text_.clear();
+    stop_matched_ = false;
+}
+
+// the streamed text must equal the result, which ends before the stop sequence. generation notices a stop
+// sequence only after the token completing it was streamed, so the longest end of the text which is the start
+// of a stop sequence is held back until the next token shows whether the stop sequence follows
+bool TextBindStreamer::send(const std::string &text, bool flush) {
+    std::string out;
+    if (!stop_matched_) {
+        held_text_ += text;
+        size_t stop_pos = std::string::npos;
+        for (const std::string &stop : stop_sequences_) {
+            if (!stop.empty()) {
+                stop_pos = std::min(stop_pos, held_text_.find(stop));
+            }
+        }
+
+        size_t keep = 0;
+        if (stop_pos != std::string::npos) {
+            held_text_.resize(stop_pos);
+            stop_matched_ = true;
+        } else if (!flush) {
+            for (const std::string &stop : stop_sequences_) {
+                for (size_t n = std::min(stop.size() - (stop.empty() ? 0 : 1), held_text_.size()); n > keep; n--) {
+                    if (held_text_.compare(held_text_.size() - n, n, stop, 0, n) == 0) {
+                        keep = n;
+                        break;
+                    }
+                }
+            }
+        }
+        out = held_text_.substr(0, held_text_.size() - keep);
+        held_text_.erase(0, held_text_.size() - keep);
+    }
+
+    // callback go function, stop generation when it returns false
+    bool ok = streamCallback(handle_, out.data(), pending_ids_.data(), pending_ids_.size());
+    pending_ids_.clear();
+    return ok;
 }
 
 
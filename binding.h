@@ -4,35 +4,135 @@ extern "C" {
 #endif
 
 #include <stdbool.h>
+#include <stdint.h>
 
-extern bool streamCallback(void *, char *);
+// tool call of a chat message, name and arguments are set for function, code for code
+typedef struct {
+    const char* type;
+    const char* name;
+    const char* arguments;
+    const char* code;
+} tool_call_message;
 
-void* load_model(const char *name);
+// chat message passed from go, the caller keeps ownership of all memory
+typedef struct {
+    const char* role;
+    const char* content;
+    tool_call_message* tool_calls;
+    int tool_calls_count;
+} chat_message;
 
-int chat(void* pipe_pr, void** history, int history_count, void* params_ptr, char* result);
+// return codes of chat, stream_chat, generate and stream_generate,
+// negative codes are errors whose message is set into err, which the caller must free
+#define GENERATE_OK 0
+#define GENERATE_CANCELLED 1
+#define GENERATE_STOPPED 2
+#define GENERATE_ERROR -1
+#define GENERATE_CONTEXT_OVERFLOW -2
 
-int stream_chat(void* pipe_pr, void** history, int history_count, void* params_ptr, char* result);
+// finish reasons reported by finishCallback
+#define FINISH_STOP 0
+#define FINISH_LENGTH 1
+#define FINISH_CANCELLED 2
+#define FINISH_CALLBACK 3
+#define FINISH_STOP_SEQUENCE 4
 
-int generate(void* pipe_pr, const char *prompt, void* params_ptr, char* result);
+// pooling of embed, same values as go Pooling
+#define POOLING_MEAN 0
+#define POOLING_LAST 1
+#define POOLING_CLS 2
 
-int stream_generate(void* pipe_pr, const char *prompt, void* params_ptr, char* result);
+// go callbacks, handle identifies the go request which the generation belongs to
+extern bool streamCallback(uintptr_t, char *, int *, int);
 
-int get_embedding(void* pipe_pr, const char *prompt, int max_length, int * result);
+extern bool cancelCallback(uintptr_t);
+
+// index is the candidate of the request, stop index is the matched stop sequence, or -1
+extern void finishCallback(uintptr_t, int, int, int, int, int, double, double, double);
+
+// output text is handed to go by length, so it may contain any bytes
+extern void resultCallback(uintptr_t, int, char *, int);
+
+// log-probability of a generated token and of the most likely tokens at its position
+extern void logprobCallback(uintptr_t, int, int, char *, float, int *, char **, float *, int);
+
+// set the tokens which the grammar allows after the last token into the mask, return whether it is complete
+extern bool grammarCallback(uintptr_t, int, int, unsigned char *, int);
+
+void* load_model(const char *name, char** err);
+
+int chat(void* pipe_pr, uintptr_t handle, const chat_message* messages, int messages_count, void* params_ptr, char** err);
+
+int stream_chat(void* pipe_pr, uintptr_t handle, const chat_message* messages, int messages_count, void* params_ptr, char** err);
+
+int generate(void* pipe_pr, uintptr_t handle, const char *prompt, void* params_ptr, char** err);
+
+int stream_generate(void* pipe_pr, uintptr_t handle, const char *prompt, void* params_ptr, char** err);
+
+int get_embedding(void* pipe_pr, const char *prompt, int max_length, int * result, char** err);
+
+int get_hidden_size(void* pipe_pr);
+
+int get_vocab_size(void* pipe_pr);
+
+// live_objects count the params, streamers and converted messages of the binding which are not released yet
+int live_objects();
+
+int embed(void* pipe_pr, const char *text, int max_length, int pooling, int num_threads, float* result, char** err);
+
+// log-likelihood of every token of ids into result, result[0] is 0, window_size 0 evaluates all ids at once
+int score(void* pipe_pr, const int* ids, int count, int window_size, int stride, int num_threads, float* result,
+          char** err);
+
+// tokenize, detokenize, token_to_piece, token_pieces, render_prompt and vocab_texts return malloc memory which the caller must free
+
+int* tokenize(void* pipe_pr, const char *text, int* count, char** err);
+
+// bytes every token adds to the output concatenated, lengths[id] is -1 for special tokens
+char* vocab_texts(void* pipe_pr, int vocab_size, int* lengths, char** err);
+
+char* detokenize(void* pipe_pr, const int* ids, int count, int* length, char** err);
+
+char* token_to_piece(void* pipe_pr, int id, int* length, char** err);
+
+// pieces of count ids concatenated, lengths[i] is the length of the piece of ids[i]
+char* token_pieces(void* pipe_pr, const int* ids, int count, int* lengths, char** err);
+
+char* render_prompt(void* pipe_pr, const chat_message* messages, int messages_count, int max_context_length,
+                    int* length, int** ids, int* ids_count, char** err);
 
 void* allocate_params(int max_length, int max_context_length, bool do_sample, int top_k,
                       float top_p, float temperature, float repetition_penalty, int num_threads);
 
-void free_params(void* params_ptr);
+void add_stop_sequence(void* params_ptr, const char* stop);
 
-void free_model(void* pipe_pr);
+// negative seed draws a fresh seed for every request
+void set_seed(void* params_ptr, int64_t seed);
 
-void* create_chat_message(const char* role, const char *content, void** tool_calls, int tool_calls_count);
+// samplers implemented by the binding, min_p 0, typical_p 1, zero penalties and no_repeat_ngram_size 0 disable them
+void set_sampling(void* params_ptr, float min_p, float typical_p, float presence_penalty,
+                  float frequency_penalty, int penalty_window, int no_repeat_ngram_size);
 
-void* create_tool_call(const char* type, void* codeOrFunc);
+// bias is added to the logit of token_id before sampling, -INFINITY bans the token
+void set_logit_bias(void* params_ptr, int token_id, float bias);
 
-void* create_function(const char* name, const char *arguments);
+void add_banned_string(void* params_ptr, const char* banned);
 
-void* create_code(const char* code);
+// number of alternatives reported with every generated token, 0 disables logprobs
+void set_logprobs(void* params_ptr, int logprobs);
+
+// generate max(n, best_of) candidates of which go keeps the n most likely
+void set_choices(void* params_ptr, int n, int best_of);
+
+// num_beams > 1 decodes with beam search instead of sampling
+void set_beam_search(void* params_ptr, int num_beams, float length_penalty, bool early_stopping);
+
+// mask tokens by grammarCallback before sampling
+void set_grammar(void* params_ptr, bool grammar);
+
+void free_params(void* params_ptr);
+
+void free_model(void* pipe_pr);
 
 char* get_model_type(void* pipe_pr);
 
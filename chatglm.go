@@ -11,48 +11,77 @@ package chatglm
 import "C"
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"runtime/cgo"
+	"sort"
 	"strings"
 	"sync"
 	"unsafe"
 )
 
+// Chatglm is a loaded chatglm.cpp pipeline.
+//
+// The pipeline owns a single kv cache, so generation calls on one Chatglm are
+// serialised by an internal mutex: it is safe to share a Chatglm between
+// goroutines, concurrent requests simply wait for each other. Load several
+// Chatglm instances to serve requests in parallel.
 type Chatglm struct {
 	pipeline unsafe.Pointer
-	// default stream, of course you can customize stream by  StreamCallback
+	// mu serialises generation on pipeline
+	mu sync.Mutex
+	// default stream, of course you can customize stream by  StreamCallback,
+	// it is reset at the beginning of every streaming call which uses it
 	stream strings.Builder
+
+	// vocabulary for grammars, loaded by the first request with a grammar
+	vocabOnce sync.Once
+	vocab     *vocabulary
+	vocabErr  error
 }
 
 // New create llm struct
 func New(model string) (*Chatglm, error) {
 	modelPath := C.CString(model)
 	defer C.free(unsafe.Pointer(modelPath))
-	result := C.load_model(modelPath)
+	var cErr *C.char
+	result := C.load_model(modelPath, &cErr)
 	if result == nil {
-		return nil, fmt.Errorf("failed loading model")
+		return nil, &Error{Op: "load model", Message: takeError(cErr), Err: ErrModelLoad}
 	}
 
 	llm := &Chatglm{pipeline: result}
 	return llm, nil
 }
 
+// NewAssistantMsg convert the output of chat into a message for the history. for ChatGLM3 a function call
+// becomes a TypeFunction tool call with its keyword arguments as JSON, Content keeps the raw call which
+// is what the model sees in the history. code after the delimiter, or after an interpreter line starting
+// the reply, becomes a TypeCode tool call
 func NewAssistantMsg(input string, modelType string) *ChatMessage {
 	result := &ChatMessage{Role: RoleAssistant, Content: input}
 	if modelType != "ChatGLM3" {
 		return result
 	}
 
-	if !strings.Contains(input, DELIMITER) {
+	ciPos := strings.Index(input, DELIMITER)
+	body := input
+	if ciPos >= 0 {
+		body = input[ciPos+len(DELIMITER):]
+	}
+	call := parseToolCallMessage(body)
+	if call == nil && ciPos >= 0 {
+		// whatever follows the delimiter is code
+		call = &ToolCallMessage{Type: TypeCode, Code: &CodeMessage{body}}
+	}
+	if call == nil {
 		return result
 	}
-
-	ciPos := strings.Index(input, DELIMITER)
-	if ciPos != 0 {
-		content := input[:ciPos]
-		code := input[ciPos+len(DELIMITER):]
-		toolCalls := []*ToolCallMessage{{Type: TypeCode, Code: &CodeMessage{code}}}
-		result.Content = content
-		result.ToolCalls = toolCalls
+	result.ToolCalls = []*ToolCallMessage{call}
+	if call.Type == TypeCode {
+		// the text before the delimiter, empty when the call starts the reply
+		result.Content = input[:max(ciPos, 0)]
 	}
 	return result
 }
@@ -71,151 +100,523 @@ func NewObservationMsg(content string) *ChatMessage {
 
 // Chat by history [synchronous]
 func (llm *Chatglm) Chat(messages []*ChatMessage, opts ...GenerationOption) (string, error) {
-	err := checkChatMessages(messages)
-	if err != nil {
-		return "", err
+	return llm.ChatContext(context.Background(), messages, opts...)
+}
+
+// ChatContext chat by history [synchronous], generation stops as soon as ctx is done,
+// and the text generated so far is returned with an error matching both ErrCancelled and ctx.Err()
+func (llm *Chatglm) ChatContext(ctx context.Context, messages []*ChatMessage, opts ...GenerationOption) (string, error) {
+	res, err := llm.chat(ctx, messages, NewGenerationOptions(opts...), false)
+	return res.Text, err
+}
+
+// StreamChat chat with stream output by StreamCallback,
+// returning false from StreamCallback stops generation and ErrStopped is returned with the text so far
+func (llm *Chatglm) StreamChat(messages []*ChatMessage, opts ...GenerationOption) (string, error) {
+	return llm.StreamChatContext(context.Background(), messages, opts...)
+}
+
+// StreamChatContext chat with stream output by StreamCallback, generation stops as soon as ctx is done,
+// and the text generated so far is returned with an error matching both ErrCancelled and ctx.Err()
+func (llm *Chatglm) StreamChatContext(ctx context.Context, messages []*ChatMessage, opts ...GenerationOption) (string, error) {
+	res, err := llm.chat(ctx, messages, NewGenerationOptions(opts...), true)
+	return res.Text, err
+}
+
+// Generate by prompt [synchronous]
+func (llm *Chatglm) Generate(prompt string, opts ...GenerationOption) (string, error) {
+	return llm.GenerateContext(context.Background(), prompt, opts...)
+}
+
+// GenerateContext generate by prompt [synchronous], generation stops as soon as ctx is done,
+// and the text generated so far is returned with an error matching both ErrCancelled and ctx.Err()
+func (llm *Chatglm) GenerateContext(ctx context.Context, prompt string, opts ...GenerationOption) (string, error) {
+	res, err := llm.generate(ctx, prompt, NewGenerationOptions(opts...), false)
+	return res.Text, err
+}
+
+// StreamGenerate with stream output by StreamCallback,
+// returning false from StreamCallback stops generation and ErrStopped is returned with the text so far
+func (llm *Chatglm) StreamGenerate(prompt string, opts ...GenerationOption) (string, error) {
+	return llm.StreamGenerateContext(context.Background(), prompt, opts...)
+}
+
+// StreamGenerateContext with stream output by StreamCallback, generation stops as soon as ctx is done,
+// and the text generated so far is returned with an error matching both ErrCancelled and ctx.Err()
+func (llm *Chatglm) StreamGenerateContext(ctx context.Context, prompt string, opts ...GenerationOption) (string, error) {
+	res, err := llm.generate(ctx, prompt, NewGenerationOptions(opts...), true)
+	return res.Text, err
+}
+
+// ChatResult chat by history like ChatContext, the output is streamed when StreamCallback is set,
+// the returned Result also reports finish reason, token usage and timings
+func (llm *Chatglm) ChatResult(ctx context.Context, messages []*ChatMessage, opts ...GenerationOption) (*Result, error) {
+	opt := NewGenerationOptions(opts...)
+	return llm.chat(ctx, messages, opt, opt.StreamCallback != nil)
+}
+
+// GenerateResult generate by prompt like GenerateContext, the output is streamed when StreamCallback is set,
+// the returned Result also reports finish reason, token usage and timings
+func (llm *Chatglm) GenerateResult(ctx context.Context, prompt string, opts ...GenerationOption) (*Result, error) {
+	opt := NewGenerationOptions(opts...)
+	return llm.generate(ctx, prompt, opt, opt.StreamCallback != nil)
+}
+
+// chat by history, stream output when stream is true
+func (llm *Chatglm) chat(ctx context.Context, messages []*ChatMessage, opt *GenerationOptions, stream bool) (*Result, error) {
+	if ctx.Err() != nil {
+		return &Result{}, cancelledError(ctx)
 	}
-	reverseMsgs, err := allocateChatMessages(messages)
+	err := checkChatMessages(messages)
 	if err != nil {
-		return "", err
+		return &Result{}, err
 	}
-	reverseCount := len(reverseMsgs)
-	pass := &reverseMsgs[0]
+	var arena cArena
+	defer arena.free()
+	cMessages := allocateChatMessages(&arena, messages)
 
-	opt := NewGenerationOptions(opts...)
 	params := allocateParams(opt)
 	defer freeParams(params)
 
-	if opt.MaxContextLength == 0 {
-		opt.MaxContextLength = 99999999
+	if err := llm.lock(); err != nil {
+		return &Result{}, err
+	}
+	defer llm.mu.Unlock()
+	req := &request{ctx: ctx, opt: opt}
+	if stream {
+		req.callback = llm.selectStreamCallback(opt)
 	}
-	out := make([]byte, opt.MaxContextLength)
-	success := C.chat(llm.pipeline, pass, C.int(reverseCount), params, (*C.char)(unsafe.Pointer(&out[0])))
+	if err := llm.setGrammar(req); err != nil {
+		return &Result{}, err
+	}
+	handle := cgo.NewHandle(req)
+	defer handle.Delete()
 
-	if success != 0 {
-		return "", fmt.Errorf("model chat failed")
+	var result C.int
+	var cErr *C.char
+	if stream {
+		result = C.stream_chat(llm.pipeline, C.uintptr_t(handle), cMessages, C.int(len(messages)), params, &cErr)
+	} else {
+		result = C.chat(llm.pipeline, C.uintptr_t(handle), cMessages, C.int(len(messages)), params, &cErr)
 	}
-	res := C.GoString((*C.char)(unsafe.Pointer(&out[0])))
-	res = removeSpecialTokens(res)
-	return res, nil
-}
 
-// StreamChat chat with stream output by StreamCallback
-func (llm *Chatglm) StreamChat(messages []*ChatMessage, opts ...GenerationOption) (string, error) {
-	err := checkChatMessages(messages)
-	if err != nil {
-		return "", err
+	if result < 0 {
+		return &Result{}, generateError("model chat", result, cErr)
 	}
-	reverseMsgs, err := allocateChatMessages(messages)
-	if err != nil {
-		return "", err
+	req.finish(trimReply)
+	req.result.Message = NewAssistantMsg(req.result.Text, llm.modelType())
+	return &req.result, req.statusError(result)
+}
+
+// generate by prompt, stream output when stream is true
+func (llm *Chatglm) generate(ctx context.Context, prompt string, opt *GenerationOptions, stream bool) (*Result, error) {
+	if ctx.Err() != nil {
+		return &Result{}, cancelledError(ctx)
 	}
-	reverseCount := len(reverseMsgs)
-	pass := &reverseMsgs[0]
+	var arena cArena
+	defer arena.free()
+	cPrompt := arena.cString(prompt)
 
-	opt := NewGenerationOptions(opts...)
 	params := allocateParams(opt)
 	defer freeParams(params)
 
-	if opt.StreamCallback != nil {
-		setStreamCallback(llm.pipeline, opt.StreamCallback)
+	if err := llm.lock(); err != nil {
+		return &Result{}, err
+	}
+	defer llm.mu.Unlock()
+	req := &request{ctx: ctx, opt: opt}
+	if stream {
+		req.callback = llm.selectStreamCallback(opt)
+	}
+	if err := llm.setGrammar(req); err != nil {
+		return &Result{}, err
+	}
+	handle := cgo.NewHandle(req)
+	defer handle.Delete()
+
+	var result C.int
+	var cErr *C.char
+	if stream {
+		result = C.stream_generate(llm.pipeline, C.uintptr_t(handle), cPrompt, params, &cErr)
 	} else {
-		setStreamCallback(llm.pipeline, defaultStreamCallback(llm))
+		result = C.generate(llm.pipeline, C.uintptr_t(handle), cPrompt, params, &cErr)
+	}
+
+	if result < 0 {
+		return &Result{}, generateError("model generate", result, cErr)
+	}
+	req.finish(func(text string) string {
+		return strings.TrimPrefix(strings.TrimPrefix(text, " "), "\n")
+	})
+	return &req.result, req.statusError(result)
+}
+
+// Embeddings get text input_ids,
+//
+// Deprecated: Embeddings returns token ids padded to MaxLength,
+// use Embed for text embeddings and Tokenize for token ids.
+func (llm *Chatglm) Embeddings(text string, opts ...GenerationOption) ([]int, error) {
+	opt := NewGenerationOptions(opts...)
+	input := C.CString(text)
+	defer C.free(unsafe.Pointer(input))
+	if opt.MaxLength == 0 {
+		opt.MaxLength = 99999999
 	}
-	defer setStreamCallback(llm.pipeline, nil)
+	cInts := make([]C.int, opt.MaxLength)
 
-	if opt.MaxContextLength == 0 {
-		opt.MaxContextLength = 99999999
+	if err := llm.lock(); err != nil {
+		return nil, err
 	}
-	out := make([]byte, opt.MaxContextLength)
-	success := C.stream_chat(llm.pipeline, pass, C.int(reverseCount), params, (*C.char)(unsafe.Pointer(&out[0])))
-	if success != 0 {
-		return "", fmt.Errorf("model chat failed")
+	defer llm.mu.Unlock()
+	var cErr *C.char
+	ret := C.get_embedding(llm.pipeline, input, C.int(opt.MaxLength), &cInts[0], &cErr)
+	ints := make([]int, opt.MaxLength)
+	for i, id := range cInts {
+		ints[i] = int(id)
 	}
-	res := C.GoString((*C.char)(unsafe.Pointer(&out[0])))
-	res = removeSpecialTokens(res)
-	return res, nil
+	if ret != 0 {
+		return ints, generateError("embedding", ret, cErr)
+	}
+
+	return ints, nil
 }
 
-// Generate by prompt [synchronous]
-func (llm *Chatglm) Generate(prompt string, opts ...GenerationOption) (string, error) {
+// Embed run the transformer over text and return its pooled final hidden states,
+// pooling is selected by SetPooling and L2 normalisation by SetNormalize, text is truncated to MaxLength tokens
+func (llm *Chatglm) Embed(text string, opts ...GenerationOption) ([]float32, error) {
 	opt := NewGenerationOptions(opts...)
-	params := allocateParams(opt)
-	defer freeParams(params)
+	input := C.CString(text)
+	defer C.free(unsafe.Pointer(input))
 
-	if opt.MaxContextLength == 0 {
-		opt.MaxContextLength = 99999999
+	if err := llm.lock(); err != nil {
+		return nil, err
+	}
+	defer llm.mu.Unlock()
+	embedding := make([]float32, int(C.get_hidden_size(llm.pipeline)))
+	var cErr *C.char
+	ret := C.embed(llm.pipeline, input, C.int(opt.MaxLength), C.int(opt.Pooling), C.int(opt.NumThreads),
+		(*C.float)(unsafe.Pointer(&embedding[0])), &cErr)
+	if ret != 0 {
+		return nil, generateError("embed", ret, cErr)
 	}
-	out := make([]byte, opt.MaxContextLength)
-	result := C.generate(llm.pipeline, C.CString(prompt), params, (*C.char)(unsafe.Pointer(&out[0])))
 
-	if result != 0 {
-		return "", fmt.Errorf("model generate failed")
+	if opt.Normalize {
+		normalize(embedding)
 	}
-	res := C.GoString((*C.char)(unsafe.Pointer(&out[0])))
-	res = strings.TrimPrefix(res, " ")
-	res = strings.TrimPrefix(res, "\n")
-	return res, nil
+	return embedding, nil
 }
 
-// StreamGenerate with stream output by StreamCallback
-func (llm *Chatglm) StreamGenerate(prompt string, opts ...GenerationOption) (string, error) {
-	opt := NewGenerationOptions(opts...)
-	params := allocateParams(opt)
-	defer freeParams(params)
+// Score run the model over text without sampling and return the log-likelihood of every token given
+// the tokens before it, text must fit in the model's max_length
+func (llm *Chatglm) Score(text string, opts ...GenerationOption) (ScoreResult, error) {
+	return llm.score(text, 0, 0, NewGenerationOptions(opts...))
+}
 
-	if opt.StreamCallback != nil {
-		setStreamCallback(llm.pipeline, opt.StreamCallback)
-	} else {
-		setStreamCallback(llm.pipeline, defaultStreamCallback(llm))
+// Perplexity of text, which is evaluated in windows of windowSize tokens starting every stride tokens,
+// so texts longer than the model's max_length get at least windowSize-stride tokens of context.
+// windowSize 0 evaluates the whole text at once
+func (llm *Chatglm) Perplexity(text string, windowSize, stride int, opts ...GenerationOption) (float64, error) {
+	res, err := llm.score(text, windowSize, stride, NewGenerationOptions(opts...))
+	if err != nil {
+		return 0, err
+	}
+	return res.Perplexity, nil
+}
+
+func (llm *Chatglm) score(text string, windowSize, stride int, opt *GenerationOptions) (ScoreResult, error) {
+	// tokenize, score and look up the pieces under one lock, the pieces with a single call
+	if err := llm.lock(); err != nil {
+		return ScoreResult{}, err
+	}
+	defer llm.mu.Unlock()
+	ids, err := llm.tokenize(text)
+	if err != nil {
+		return ScoreResult{}, err
+	}
+	if len(ids) < 2 {
+		return ScoreResult{}, &Error{Op: "score", Message: fmt.Sprintf("text has %d tokens, at least 2 are needed", len(ids))}
 	}
-	defer setStreamCallback(llm.pipeline, nil)
+	cIds := make([]C.int, len(ids))
+	for i, id := range ids {
+		cIds[i] = C.int(id)
+	}
+	logprobs := make([]float32, len(ids))
 
-	if opt.MaxContextLength == 0 {
-		opt.MaxContextLength = 99999999
+	var cErr *C.char
+	ret := C.score(llm.pipeline, &cIds[0], C.int(len(cIds)), C.int(windowSize), C.int(stride), C.int(opt.NumThreads),
+		(*C.float)(unsafe.Pointer(&logprobs[0])), &cErr)
+	if ret != 0 {
+		return ScoreResult{}, generateError("score", ret, cErr)
 	}
-	out := make([]byte, opt.MaxContextLength)
-	result := C.stream_generate(llm.pipeline, C.CString(prompt), params, (*C.char)(unsafe.Pointer(&out[0])))
 
-	if result != 0 {
-		return "", fmt.Errorf("model generate failed")
+	pieces, err := llm.tokenPieces(cIds[1:])
+	if err != nil {
+		return ScoreResult{}, err
+	}
+	res := ScoreResult{Tokens: make([]TokenLogprob, 0, len(ids)-1)}
+	for i := 1; i < len(ids); i++ {
+		res.Tokens = append(res.Tokens, TokenLogprob{Id: ids[i], Piece: pieces[i-1], Logprob: logprobs[i]})
+		res.LogLikelihood += float64(logprobs[i])
 	}
-	res := C.GoString((*C.char)(unsafe.Pointer(&out[0])))
-	res = strings.TrimPrefix(res, " ")
-	res = strings.TrimPrefix(res, "\n")
+	res.Perplexity = math.Exp(-res.LogLikelihood / float64(len(res.Tokens)))
 	return res, nil
 }
 
-// Embeddings get text input_ids,
-func (llm *Chatglm) Embeddings(text string, opts ...GenerationOption) ([]int, error) {
-	opt := NewGenerationOptions(opts...)
+// Tokenize encode text into token ids the same way a Generate prompt is encoded, without padding
+func (llm *Chatglm) Tokenize(text string) ([]int, error) {
+	if err := llm.lock(); err != nil {
+		return nil, err
+	}
+	defer llm.mu.Unlock()
+	return llm.tokenize(text)
+}
+
+// tokenize is Tokenize, mu must be held
+func (llm *Chatglm) tokenize(text string) ([]int, error) {
 	input := C.CString(text)
-	if opt.MaxLength == 0 {
-		opt.MaxLength = 99999999
+	defer C.free(unsafe.Pointer(input))
+
+	var count C.int
+	var cErr *C.char
+	cIds := C.tokenize(llm.pipeline, input, &count, &cErr)
+	if cErr != nil {
+		return nil, &Error{Op: "tokenize", Message: takeError(cErr)}
 	}
-	ints := make([]int, opt.MaxLength)
+	defer C.free(unsafe.Pointer(cIds))
 
-	ret := C.get_embedding(llm.pipeline, input, C.int(opt.MaxLength), (*C.int)(unsafe.Pointer(&ints[0])))
-	if ret != 0 {
-		return ints, fmt.Errorf("embedding failed")
+	return goInts(cIds, count), nil
+}
+
+// Detokenize decode token ids into text
+func (llm *Chatglm) Detokenize(ids []int) (string, error) {
+	cIds := make([]C.int, len(ids))
+	for i, id := range ids {
+		cIds[i] = C.int(id)
+	}
+	var pass *C.int
+	if len(cIds) > 0 {
+		pass = &cIds[0]
 	}
 
-	return ints, nil
+	if err := llm.lock(); err != nil {
+		return "", err
+	}
+	defer llm.mu.Unlock()
+	var length C.int
+	var cErr *C.char
+	text := C.detokenize(llm.pipeline, pass, C.int(len(cIds)), &length, &cErr)
+	if cErr != nil {
+		return "", &Error{Op: "detokenize", Message: takeError(cErr)}
+	}
+	defer C.free(unsafe.Pointer(text))
+	return C.GoStringN(text, length), nil
 }
 
+// RenderPrompt return the prompt Chat feeds to the model for messages, as text with role tokens
+// such as <|user|> and as token ids, after the truncation to MaxContextLength
+func (llm *Chatglm) RenderPrompt(messages []*ChatMessage, opts ...GenerationOption) (string, []int, error) {
+	err := checkChatMessages(messages)
+	if err != nil {
+		return "", nil, err
+	}
+	opt := NewGenerationOptions(opts...)
+
+	var arena cArena
+	defer arena.free()
+	cMessages := allocateChatMessages(&arena, messages)
+
+	if err := llm.lock(); err != nil {
+		return "", nil, err
+	}
+	defer llm.mu.Unlock()
+	var length, count C.int
+	var cIds *C.int
+	var cErr *C.char
+	text := C.render_prompt(llm.pipeline, cMessages, C.int(len(messages)), C.int(opt.MaxContextLength),
+		&length, &cIds, &count, &cErr)
+	if cErr != nil {
+		return "", nil, &Error{Op: "render prompt", Message: takeError(cErr)}
+	}
+	defer C.free(unsafe.Pointer(text))
+	defer C.free(unsafe.Pointer(cIds))
+	return C.GoStringN(text, length), goInts(cIds, count), nil
+}
+
+// CountTokens number of tokens of text as a Generate prompt
+func (llm *Chatglm) CountTokens(text string) (int, error) {
+	ids, err := llm.Tokenize(text)
+	return len(ids), err
+}
+
+// TokenToPiece return the vocabulary piece of a token id, special tokens like <|user|> included
+func (llm *Chatglm) TokenToPiece(id int) (string, error) {
+	if err := llm.lock(); err != nil {
+		return "", err
+	}
+	defer llm.mu.Unlock()
+	var length C.int
+	var cErr *C.char
+	piece := C.token_to_piece(llm.pipeline, C.int(id), &length, &cErr)
+	if cErr != nil {
+		return "", &Error{Op: "token to piece", Message: takeError(cErr)}
+	}
+	defer C.free(unsafe.Pointer(piece))
+	return C.GoStringN(piece, length), nil
+}
+
+// tokenPieces look up the vocabulary pieces of ids, mu must be held
+func (llm *Chatglm) tokenPieces(ids []C.int) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	lengths := make([]C.int, len(ids))
+	var cErr *C.char
+	cPieces := C.token_pieces(llm.pipeline, &ids[0], C.int(len(ids)), &lengths[0], &cErr)
+	if cErr != nil {
+		return nil, &Error{Op: "token to piece", Message: takeError(cErr)}
+	}
+	defer C.free(unsafe.Pointer(cPieces))
+
+	pieces := make([]string, len(ids))
+	offset := 0
+	for i, length := range lengths {
+		pieces[i] = C.GoStringN((*C.char)(unsafe.Add(unsafe.Pointer(cPieces), offset)), length)
+		offset += int(length)
+	}
+	return pieces, nil
+}
+
+// Free release the model, later calls return ErrModelFreed
 func (llm *Chatglm) Free() {
+	llm.mu.Lock()
+	defer llm.mu.Unlock()
+	if llm.pipeline == nil {
+		return
+	}
 	C.free_model(llm.pipeline)
+	llm.pipeline = nil
 }
 
+// ModelType name the model architecture like ChatGLM3, empty once the model is freed
 func (llm *Chatglm) ModelType() string {
-	return C.GoString(C.get_model_type(llm.pipeline))
+	if llm.lock() != nil {
+		return ""
+	}
+	defer llm.mu.Unlock()
+	return llm.modelType()
+}
+
+// modelType of the pipeline, mu must be held
+func (llm *Chatglm) modelType() string {
+	modelType := C.get_model_type(llm.pipeline)
+	defer C.free(unsafe.Pointer(modelType))
+	return C.GoString(modelType)
+}
+
+// lock take mu unless the model is freed, the caller unlocks mu when lock returns nil
+func (llm *Chatglm) lock() error {
+	llm.mu.Lock()
+	if llm.pipeline == nil {
+		llm.mu.Unlock()
+		return ErrModelFreed
+	}
+	return nil
 }
 
 // allocateParams create GenerationOptions from c
 func allocateParams(opt *GenerationOptions) unsafe.Pointer {
-	return C.allocate_params(C.int(opt.MaxLength), C.int(opt.MaxContextLength), C.bool(opt.DoSample),
+	params := C.allocate_params(C.int(opt.MaxLength), C.int(opt.MaxContextLength), C.bool(opt.DoSample),
 		C.int(opt.TopK), C.float(opt.TopP), C.float(opt.Temperature), C.float(opt.RepetitionPenalty),
 		C.int(opt.NumThreads))
+	for _, stop := range opt.StopSequences {
+		cStop := C.CString(stop)
+		C.add_stop_sequence(params, cStop)
+		C.free(unsafe.Pointer(cStop))
+	}
+	C.set_seed(params, C.int64_t(opt.Seed))
+	C.set_sampling(params, C.float(opt.MinP), C.float(opt.TypicalP), C.float(opt.PresencePenalty),
+		C.float(opt.FrequencyPenalty), C.int(opt.PenaltyWindow), C.int(opt.NoRepeatNgramSize))
+	for id, bias := range opt.LogitBias {
+		C.set_logit_bias(params, C.int(id), C.float(bias))
+	}
+	for _, id := range opt.BannedTokens {
+		C.set_logit_bias(params, C.int(id), C.float(math.Inf(-1)))
+	}
+	for _, banned := range opt.BannedStrings {
+		cBanned := C.CString(banned)
+		C.add_banned_string(params, cBanned)
+		C.free(unsafe.Pointer(cBanned))
+	}
+	C.set_logprobs(params, C.int(opt.Logprobs))
+	C.set_choices(params, C.int(opt.N), C.int(opt.BestOf))
+	C.set_beam_search(params, C.int(opt.NumBeams), C.float(opt.LengthPenalty), C.bool(opt.EarlyStopping))
+	C.set_grammar(params, C.bool(opt.Grammar != ""))
+	return params
+}
+
+// setGrammar parse the grammar of the request and load the vocabulary which masks tokens by it
+func (llm *Chatglm) setGrammar(req *request) error {
+	if req.opt.Grammar == "" {
+		return nil
+	}
+	if req.opt.NumBeams > 1 {
+		return fmt.Errorf("%w: grammar does not apply to beam search", ErrInvalidGrammar)
+	}
+	g, err := parseGrammarOption(req.opt.Grammar)
+	if err != nil {
+		return err
+	}
+	vocab, err := llm.loadVocabulary()
+	if err != nil {
+		return err
+	}
+	req.grammar, req.vocab = g, vocab
+	return nil
+}
+
+// loadVocabulary read the text of every token once, mu must be held
+func (llm *Chatglm) loadVocabulary() (*vocabulary, error) {
+	llm.vocabOnce.Do(func() {
+		vocabSize := int(C.get_vocab_size(llm.pipeline))
+		lengths := make([]C.int, vocabSize)
+		var cErr *C.char
+		cTexts := C.vocab_texts(llm.pipeline, C.int(vocabSize), &lengths[0], &cErr)
+		if cErr != nil {
+			llm.vocabErr = &Error{Op: "load vocabulary", Message: takeError(cErr)}
+			return
+		}
+		defer C.free(unsafe.Pointer(cTexts))
+
+		texts := make([][]byte, vocabSize)
+		offset := 0
+		for id, length := range lengths {
+			if length < 0 {
+				continue
+			}
+			texts[id] = C.GoBytes(unsafe.Add(unsafe.Pointer(cTexts), offset), length)
+			offset += int(length)
+		}
+		llm.vocab = newVocabulary(texts)
+	})
+	return llm.vocab, llm.vocabErr
+}
+
+// takeError copy the error message set by the binding and free it
+func takeError(cErr *C.char) string {
+	if cErr == nil {
+		return ""
+	}
+	defer C.free(unsafe.Pointer(cErr))
+	return C.GoString(cErr)
+}
+
+// generateError convert a negative return code of the binding into *Error
+func generateError(op string, result C.int, cErr *C.char) error {
+	err := &Error{Op: op, Message: takeError(cErr)}
+	if result == C.GENERATE_CONTEXT_OVERFLOW {
+		err.Err = ErrContextOverflow
+	}
+	return err
 }
 
 // freeParams
@@ -227,15 +628,15 @@ func freeParams(params unsafe.Pointer) {
 func checkChatMessages(messages []*ChatMessage) error {
 	n := len(messages)
 	if n < 1 {
-		return fmt.Errorf("invalid chat messages size: %d", n)
+		return fmt.Errorf("%w size: %d", ErrInvalidMessages, n)
 	}
 	isSys := messages[0].Role == RoleSystem
 
 	if !isSys && n%2 == 0 {
-		return fmt.Errorf("invalid chat messages size: %d", n)
+		return fmt.Errorf("%w size: %d", ErrInvalidMessages, n)
 	}
 	if isSys && n%2 == 1 {
-		return fmt.Errorf("invalid chat messages size: %d", n)
+		return fmt.Errorf("%w size: %d", ErrInvalidMessages, n)
 	}
 
 	for i, message := range messages {
@@ -245,87 +646,291 @@ func checkChatMessages(messages []*ChatMessage) error {
 
 		for j, toolCall := range message.ToolCalls {
 			if toolCall.Type == TypeCode && toolCall.Code == nil {
-				return fmt.Errorf("expect messages[%d].ToolCalls[%d].Code is not nil", i, j)
+				return fmt.Errorf("%w: expect messages[%d].ToolCalls[%d].Code is not nil", ErrInvalidMessages, i, j)
 			}
 			if toolCall.Type == TypeFunction && toolCall.Function == nil {
-				return fmt.Errorf("expect messages[%d].ToolCalls[%d].Function is not nil", i, j)
+				return fmt.Errorf("%w: expect messages[%d].ToolCalls[%d].Function is not nil", ErrInvalidMessages, i, j)
 			}
 		}
 	}
 	return nil
 }
 
-// allocateChatMessages covert []*ChatMessage in go to []C.ChatMessage in c++
-func allocateChatMessages(messages []*ChatMessage) ([]unsafe.Pointer, error) {
-	reverseMessages := make([]unsafe.Pointer, len(messages))
+// liveObjects number of binding objects not released yet, see live_objects in binding.h
+func liveObjects() int {
+	return int(C.live_objects())
+}
+
+// cArena owns the C memory passed into a single binding call
+type cArena struct {
+	ptrs []unsafe.Pointer
+}
+
+func (a *cArena) malloc(size int) unsafe.Pointer {
+	ptr := C.malloc(C.size_t(size))
+	a.ptrs = append(a.ptrs, ptr)
+	return ptr
+}
+
+func (a *cArena) cString(s string) *C.char {
+	ptr := C.CString(s)
+	a.ptrs = append(a.ptrs, unsafe.Pointer(ptr))
+	return ptr
+}
+
+// free release all memory of the arena
+func (a *cArena) free() {
+	for _, ptr := range a.ptrs {
+		C.free(ptr)
+	}
+	a.ptrs = nil
+}
+
+// allocateChatMessages covert []*ChatMessage in go to a flat C.chat_message array owned by arena
+func allocateChatMessages(arena *cArena, messages []*ChatMessage) *C.chat_message {
+	cMessages := unsafe.Slice((*C.chat_message)(arena.malloc(len(messages)*C.sizeof_chat_message)), len(messages))
 	for i, message := range messages {
-		var reverseToolCalls []unsafe.Pointer
-		if message.ToolCalls != nil {
-			for _, toolCall := range message.ToolCalls {
-				var codeOrFunc unsafe.Pointer
-				if toolCall.Type == TypeCode {
-					codeOrFunc = C.create_code(C.CString(toolCall.Code.Input))
-				} else if toolCall.Type == TypeFunction {
-					codeOrFunc = C.create_function(
-						C.CString(toolCall.Function.Name), C.CString(toolCall.Function.Arguments))
-				}
-				toolCallPoint := C.create_tool_call(C.CString(toolCall.Type), codeOrFunc)
-				if toolCallPoint != nil {
-					reverseToolCalls = append(reverseToolCalls, toolCallPoint)
-				}
-			}
+		cMessages[i] = C.chat_message{
+			role:    arena.cString(message.Role),
+			content: arena.cString(message.Content),
 		}
-		var pass *unsafe.Pointer
-		if len(reverseToolCalls) > 0 {
-			pass = &reverseToolCalls[0]
+		if len(message.ToolCalls) == 0 {
+			continue
+		}
+
+		cToolCalls := unsafe.Slice((*C.tool_call_message)(arena.malloc(len(message.ToolCalls)*C.sizeof_tool_call_message)),
+			len(message.ToolCalls))
+		for j, toolCall := range message.ToolCalls {
+			var name, arguments, code string
+			if toolCall.Type == TypeFunction {
+				name, arguments = toolCall.Function.Name, toolCall.Function.Arguments
+			} else if toolCall.Type == TypeCode {
+				code = toolCall.Code.Input
+			}
+			cToolCalls[j] = C.tool_call_message{
+				_type:     arena.cString(toolCall.Type),
+				name:      arena.cString(name),
+				arguments: arena.cString(arguments),
+				code:      arena.cString(code),
+			}
 		}
-		reverseMessages[i] = C.create_chat_message(
-			C.CString(message.Role), C.CString(message.Content), pass, C.int(len(reverseToolCalls)))
-	}
-	return reverseMessages, nil
-}
-
-func removeSpecialTokens(data string) string {
-	output := strings.ReplaceAll(data, "[MASK]", "")
-	output = strings.ReplaceAll(output, "[gMASK]", "")
-	output = strings.ReplaceAll(output, "[sMASK]", "")
-	output = strings.ReplaceAll(output, "sop", "")
-	output = strings.ReplaceAll(output, "eop", "")
-	output = strings.Replace(output, "<|assistant|>", "", 1)
-	output = strings.TrimSuffix(output, "<|assistant|>")
-	output = strings.ReplaceAll(output, "<|assistant|>", DELIMITER)
-	output = strings.TrimLeftFunc(output, func(r rune) bool {
+		cMessages[i].tool_calls = &cToolCalls[0]
+		cMessages[i].tool_calls_count = C.int(len(message.ToolCalls))
+	}
+	return &cMessages[0]
+}
+
+// goInts copy a C int array
+func goInts(ptr *C.int, count C.int) []int {
+	ints := make([]int, int(count))
+	for i, v := range unsafe.Slice(ptr, int(count)) {
+		ints[i] = int(v)
+	}
+	return ints
+}
+
+// normalize scale vector to unit L2 norm
+func normalize(vector []float32) {
+	var sum float64
+	for _, v := range vector {
+		sum += float64(v) * float64(v)
+	}
+	if sum == 0 {
+		return
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range vector {
+		vector[i] /= norm
+	}
+}
+
+// trimReply drop the line break and spaces the model writes before a chat reply,
+// special tokens are already skipped by id when the output is decoded
+func trimReply(data string) string {
+	return strings.TrimLeftFunc(data, func(r rune) bool {
 		return r == '\n' || r == ' '
 	})
-	return output
 }
 
-var (
-	m         sync.RWMutex
-	callbacks = map[unsafe.Pointer]func(string) bool{}
-)
+// request is the state of a single generation call, C++ refers to it by a cgo.Handle
+type request struct {
+	ctx      context.Context
+	opt      *GenerationOptions
+	callback func(string, []int) bool
+
+	// grammar of the output with the state of every candidate
+	grammar  *grammar
+	vocab    *vocabulary
+	grammars []*grammarState
+
+	// filled by finishCallback, resultCallback and logprobCallback, then by finish
+	result  Result
+	choices []Choice
+}
+
+// statusError convert the status returned by the binding
+func (req *request) statusError(result C.int) error {
+	switch result {
+	case C.GENERATE_CANCELLED:
+		return cancelledError(req.ctx)
+	case C.GENERATE_STOPPED:
+		return ErrStopped
+	}
+	return nil
+}
+
+// choice return the index-th candidate
+func (req *request) choice(index C.int) *Choice {
+	for len(req.choices) <= int(index) {
+		req.choices = append(req.choices, Choice{Index: len(req.choices)})
+	}
+	return &req.choices[index]
+}
+
+// finish clean the text of every candidate and cut it from the matched stop sequence, keep the N most likely
+// candidates when more were generated, and fill the result from them
+func (req *request) finish(clean func(string) string) {
+	for i := range req.choices {
+		choice := &req.choices[i]
+		choice.Text = clean(choice.Text)
+		if choice.FinishReason != FinishStopSequence {
+			continue
+		}
+		if j := strings.Index(choice.Text, choice.StopSequence); j >= 0 {
+			choice.Text = choice.Text[:j]
+		}
+	}
+
+	// the first token of every candidate comes from prompt evaluation
+	timings := &req.result.Timings
+	if decoded := req.result.Usage.CompletionTokens - len(req.choices); decoded > 0 && timings.CompletionMs > 0 {
+		timings.PerTokenMs = timings.CompletionMs / float64(decoded)
+		timings.TokensPerSecond = 1000 / timings.PerTokenMs
+	}
+
+	if n := max(req.opt.N, 1); len(req.choices) > n {
+		sort.SliceStable(req.choices, func(i, j int) bool {
+			return req.choices[i].Logprob > req.choices[j].Logprob
+		})
+		req.choices = req.choices[:n]
+		for i := range req.choices {
+			req.choices[i].Index = i
+		}
+	}
+	if len(req.choices) == 0 {
+		return
+	}
+	first := req.choices[0]
+	req.result.Text = first.Text
+	req.result.FinishReason = first.FinishReason
+	req.result.StopSequence = first.StopSequence
+	req.result.Logprobs = first.Logprobs
+	req.result.Choices = req.choices
+}
+
+var finishReasons = map[C.int]FinishReason{
+	C.FINISH_STOP:          FinishStop,
+	C.FINISH_LENGTH:        FinishLength,
+	C.FINISH_CANCELLED:     FinishCancelled,
+	C.FINISH_CALLBACK:      FinishCallback,
+	C.FINISH_STOP_SEQUENCE: FinishStopSequence,
+}
 
 //export streamCallback
-func streamCallback(pipeline unsafe.Pointer, printableText *C.char) C.bool {
-	m.RLock()
-	defer m.RUnlock()
+func streamCallback(handle C.uintptr_t, printableText *C.char, ids *C.int, idsCount C.int) C.bool {
+	req := cgo.Handle(handle).Value().(*request)
+	if req.callback == nil {
+		return C.bool(true)
+	}
+
+	return C.bool(req.callback(C.GoString(printableText), goInts(ids, idsCount)))
+}
+
+//export cancelCallback
+func cancelCallback(handle C.uintptr_t) C.bool {
+	req := cgo.Handle(handle).Value().(*request)
+	return C.bool(req.ctx.Err() != nil)
+}
 
-	if callback, ok := callbacks[pipeline]; ok {
-		return C.bool(callback(C.GoString(printableText)))
+//export finishCallback
+func finishCallback(handle C.uintptr_t, index C.int, finishReason C.int, stopIndex C.int, promptTokens C.int,
+	completionTokens C.int, promptMs C.double, completionMs C.double, logprob C.double) {
+	req := cgo.Handle(handle).Value().(*request)
+	choice := req.choice(index)
+	choice.FinishReason = finishReasons[finishReason]
+	if stopIndex >= 0 {
+		choice.StopSequence = req.opt.StopSequences[stopIndex]
 	}
+	choice.Logprob = float64(logprob)
+
+	// candidates share the prompt
+	usage := &req.result.Usage
+	usage.PromptTokens = int(promptTokens)
+	usage.CompletionTokens += int(completionTokens)
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	req.result.Timings.PromptMs += float64(promptMs)
+	req.result.Timings.CompletionMs += float64(completionMs)
+}
+
+//export resultCallback
+func resultCallback(handle C.uintptr_t, index C.int, text *C.char, length C.int) {
+	req := cgo.Handle(handle).Value().(*request)
+	req.choice(index).Text = C.GoStringN(text, length)
+}
 
-	return C.bool(true)
+//export logprobCallback
+func logprobCallback(handle C.uintptr_t, index C.int, id C.int, piece *C.char, logprob C.float, topIds *C.int,
+	topPieces **C.char, topLogprobs *C.float, topCount C.int) {
+	req := cgo.Handle(handle).Value().(*request)
+	logprobs := TokenLogprobs{
+		TokenLogprob: TokenLogprob{Id: int(id), Piece: C.GoString(piece), Logprob: float32(logprob)},
+		TopLogprobs:  make([]TokenLogprob, topCount),
+	}
+	ids := unsafe.Slice(topIds, topCount)
+	pieces := unsafe.Slice(topPieces, topCount)
+	values := unsafe.Slice(topLogprobs, topCount)
+	for i := range logprobs.TopLogprobs {
+		logprobs.TopLogprobs[i] = TokenLogprob{Id: int(ids[i]), Piece: C.GoString(pieces[i]), Logprob: float32(values[i])}
+	}
+	choice := req.choice(index)
+	choice.Logprobs = append(choice.Logprobs, logprobs)
 }
 
-// setStreamCallback add callback into global map callbacks
-func setStreamCallback(pipeline unsafe.Pointer, callback func(string) bool) {
-	m.Lock()
-	defer m.Unlock()
+//export grammarCallback
+func grammarCallback(handle C.uintptr_t, index C.int, lastToken C.int, allowed *C.uchar, vocabSize C.int) C.bool {
+	req := cgo.Handle(handle).Value().(*request)
+	for len(req.grammars) <= int(index) {
+		req.grammars = append(req.grammars, nil)
+	}
 
+	state := req.grammars[index]
+	if lastToken < 0 {
+		state = newGrammarState(req.grammar)
+	} else if int(lastToken) < len(req.vocab.texts) && req.vocab.texts[lastToken] != nil {
+		// the binding only samples tokens of the previous mask, so the state always advances
+		state, _ = state.acceptText(req.vocab.texts[lastToken])
+	}
+	req.grammars[index] = state
+	if state == nil {
+		return C.bool(false)
+	}
+
+	state.allow(req.vocab.trie, unsafe.Slice((*byte)(unsafe.Pointer(allowed)), vocabSize))
+	return C.bool(state.complete())
+}
+
+// selectStreamCallback return the stream callback of opt, or reset and use default stream
+func (llm *Chatglm) selectStreamCallback(opt *GenerationOptions) func(string, []int) bool {
+	if opt.tokenCallback != nil {
+		return opt.tokenCallback
+	}
+	callback := opt.StreamCallback
 	if callback == nil {
-		delete(callbacks, pipeline)
-	} else {
-		callbacks[pipeline] = callback
+		llm.stream.Reset()
+		callback = defaultStreamCallback(llm)
+	}
+	return func(text string, _ []int) bool {
+		return callback(text)
 	}
 }
 
@@ -1,19 +1,29 @@
 package chatglm
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"os"
+	"os/exec"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var (
-	chatglm   *Chatglm
-	modelType string
+	chatglm       *Chatglm
+	modelType     string
+	testModelPath string
 )
 
 func setup() {
-	testModelPath, exist := os.LookupEnv("TEST_MODEL")
+	var exist bool
+	testModelPath, exist = os.LookupEnv("TEST_MODEL")
 	if !exist {
 		testModelPath = "chatglm3-ggml-q4_0.bin"
 	}
@@ -108,6 +118,357 @@ func TestChatStream(t *testing.T) {
 	assert.Len(t, messages, 4)
 }
 
+func TestStreamGenerateStop(t *testing.T) {
+	chunks := 0
+	ret, err := chatglm.StreamGenerate("写一篇关于春天的文章", SetStreamCallback(func(s string) bool {
+		chunks++
+		return chunks < 3
+	}))
+	assert.ErrorIs(t, err, ErrStopped)
+	assert.LessOrEqual(t, chunks, 4)
+	assert.NotEmpty(t, ret)
+}
+
+func TestStreamChatConcurrent(t *testing.T) {
+	prompts := []string{"2+2等于多少", "3+3等于多少"}
+	answers := []string{"4", "6"}
+	outs := make([]strings.Builder, len(prompts))
+	rets := make([]string, len(prompts))
+
+	var wg sync.WaitGroup
+	for i := range prompts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ret, err := chatglm.StreamChat([]*ChatMessage{NewUserMsg(prompts[i])}, SetDoSample(false),
+				SetStreamCallback(func(s string) bool {
+					outs[i].WriteString(s)
+					return true
+				}))
+			assert.NoError(t, err)
+			rets[i] = ret
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range prompts {
+		assert.Contains(t, rets[i], answers[i])
+		assert.Contains(t, outs[i].String(), answers[i])
+	}
+}
+
+func TestChatResult(t *testing.T) {
+	res, err := chatglm.ChatResult(context.Background(), []*ChatMessage{NewUserMsg("2+2等于多少")})
+	assert.NoError(t, err)
+	assert.Contains(t, res.Text, "4")
+	assert.Equal(t, FinishStop, res.FinishReason)
+	assert.Greater(t, res.Usage.PromptTokens, 0)
+	assert.Greater(t, res.Usage.CompletionTokens, 0)
+	assert.Equal(t, res.Usage.PromptTokens+res.Usage.CompletionTokens, res.Usage.TotalTokens)
+	assert.Greater(t, res.Timings.PromptMs, 0.0)
+
+	res, err = chatglm.GenerateResult(context.Background(), "写一篇关于春天的文章", SetMaxLength(32))
+	assert.NoError(t, err)
+	assert.Equal(t, FinishLength, res.FinishReason)
+	assert.Equal(t, 32, res.Usage.TotalTokens)
+	assert.Greater(t, res.Timings.TokensPerSecond, 0.0)
+}
+
+func TestGenerateShortContextLength(t *testing.T) {
+	// output is no longer bounded by MaxContextLength
+	ret, err := chatglm.Generate("写一篇关于春天的文章", SetMaxContextLength(16), SetMaxLength(256))
+	assert.NoError(t, err)
+	assert.Greater(t, len(ret), 16)
+}
+
+func TestChatNoLeak(t *testing.T) {
+	messages := []*ChatMessage{
+		NewUserMsg("生成一个随机数"),
+		{Role: RoleAssistant, Content: "", ToolCalls: []*ToolCallMessage{
+			{Type: TypeFunction, Function: &FunctionMessage{Name: "random_number_generator", Arguments: `{"seed": 42}`}},
+		}},
+		NewObservationMsg("22"),
+	}
+	before := liveObjects()
+	for i := 0; i < 20; i++ {
+		_, err := chatglm.Chat(messages, SetMaxLength(512), SetStopSequences([]string{"。"}))
+		assert.NoError(t, err)
+		_, err = chatglm.StreamChat(messages, SetMaxLength(512))
+		assert.NoError(t, err)
+		_, err = chatglm.Generate("你好", SetMaxLength(16))
+		assert.NoError(t, err)
+		_, _, err = chatglm.RenderPrompt(messages)
+		assert.NoError(t, err)
+		// the failing call must release its objects too
+		_, err = chatglm.Chat(messages, SetMaxLength(4))
+		assert.ErrorIs(t, err, ErrContextOverflow)
+	}
+	assert.Equal(t, before, liveObjects())
+}
+
+func TestFree(t *testing.T) {
+	llm, err := New(testModelPath)
+	assert.NoError(t, err)
+	llm.Free()
+	llm.Free()
+
+	_, err = llm.Tokenize("你好")
+	assert.ErrorIs(t, err, ErrModelFreed)
+	_, err = llm.Chat([]*ChatMessage{NewUserMsg("你好")})
+	assert.ErrorIs(t, err, ErrModelFreed)
+	assert.Empty(t, llm.ModelType())
+}
+
+func TestStopSequences(t *testing.T) {
+	prompt := "从1数到20，用逗号分隔："
+	res, err := chatglm.GenerateResult(context.Background(), prompt, SetDoSample(false), SetStopSequences([]string{"", "5"}))
+	assert.NoError(t, err)
+	assert.Equal(t, FinishStopSequence, res.FinishReason)
+	assert.Equal(t, "5", res.StopSequence)
+	assert.NotContains(t, res.Text, "5")
+	assert.Contains(t, res.Text, "4")
+
+	// the stop sequence is held back from the stream, so the streamed text is the result
+	streamed := strings.Builder{}
+	res, err = chatglm.GenerateResult(context.Background(), prompt, SetDoSample(false),
+		SetStopSequences([]string{"5"}), SetStreamCallback(func(text string) bool {
+			streamed.WriteString(text)
+			return true
+		}))
+	assert.NoError(t, err)
+	assert.Equal(t, FinishStopSequence, res.FinishReason)
+	assert.Equal(t, res.Text, strings.TrimLeft(streamed.String(), " \n"))
+}
+
+func TestSeed(t *testing.T) {
+	prompt := "写一句关于春天的诗"
+	first, err := chatglm.Generate(prompt, SetMaxLength(64), SetSeed(42))
+	assert.NoError(t, err)
+	second, err := chatglm.Generate(prompt, SetMaxLength(64), SetSeed(42))
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+}
+
+func TestNoRepeatNgram(t *testing.T) {
+	var ids []int
+	opt := NewGenerationOptions(SetDoSample(false), SetMaxLength(128), SetNoRepeatNgramSize(3))
+	opt.tokenCallback = func(text string, tokenIds []int) bool {
+		ids = append(ids, tokenIds...)
+		return true
+	}
+	_, err := chatglm.generate(context.Background(), "重复这句话十遍：你好世界", opt, true)
+	assert.NoError(t, err)
+	seen := map[[3]int]bool{}
+	for i := 0; i+3 <= len(ids); i++ {
+		ngram := [3]int{ids[i], ids[i+1], ids[i+2]}
+		assert.False(t, seen[ngram], "ngram %v repeated", ngram)
+		seen[ngram] = true
+	}
+}
+
+func TestBannedStrings(t *testing.T) {
+	prompt := "从1数到10，用逗号分隔："
+	res, err := chatglm.Generate(prompt, SetDoSample(false), SetMaxLength(128), SetBannedStrings([]string{"5"}))
+	assert.NoError(t, err)
+	assert.NotContains(t, res, "5")
+}
+
+func TestLogprobs(t *testing.T) {
+	res, err := chatglm.GenerateResult(context.Background(), "2+2=", SetDoSample(false), SetMaxLength(32), SetLogprobs(3))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, res.Logprobs)
+	// eos token is not reported
+	assert.LessOrEqual(t, len(res.Logprobs), res.Usage.CompletionTokens)
+	for _, logprobs := range res.Logprobs {
+		assert.LessOrEqual(t, logprobs.Logprob, float32(0))
+		assert.Len(t, logprobs.TopLogprobs, 3)
+		// greedy search picks the most likely token
+		assert.Equal(t, logprobs.TopLogprobs[0].Id, logprobs.Id)
+	}
+}
+
+func TestScore(t *testing.T) {
+	good, err := chatglm.Score("北京是中国的首都。")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, good.Tokens)
+	assert.Greater(t, good.Perplexity, 1.0)
+	for _, token := range good.Tokens {
+		piece, err := chatglm.TokenToPiece(token.Id)
+		assert.NoError(t, err)
+		assert.Equal(t, piece, token.Piece)
+	}
+
+	bad, err := chatglm.Score("首都北京中国是的。")
+	assert.NoError(t, err)
+	assert.Less(t, good.Perplexity, bad.Perplexity)
+
+	// windows that cover the whole text give the same perplexity
+	perplexity, err := chatglm.Perplexity("北京是中国的首都。", 512, 256)
+	assert.NoError(t, err)
+	assert.InDelta(t, good.Perplexity, perplexity, 1e-3)
+}
+
+func TestChoices(t *testing.T) {
+	res, err := chatglm.GenerateResult(context.Background(), "写一个水果的名字：", SetMaxLength(32), SetN(2), SetBestOf(3))
+	assert.NoError(t, err)
+	assert.Len(t, res.Choices, 2)
+	assert.Equal(t, res.Choices[0].Text, res.Text)
+	assert.GreaterOrEqual(t, res.Choices[0].Logprob, res.Choices[1].Logprob)
+	for i, choice := range res.Choices {
+		assert.Equal(t, i, choice.Index)
+		assert.LessOrEqual(t, choice.Logprob, 0.0)
+	}
+}
+
+func TestBeamSearch(t *testing.T) {
+	res, err := chatglm.GenerateResult(context.Background(), "把这句话翻译成英文：今天天气很好。", SetMaxLength(64),
+		SetNumBeams(3), SetN(3))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, res.Text)
+	assert.Len(t, res.Choices, 3)
+	assert.GreaterOrEqual(t, res.Choices[0].Logprob, res.Choices[1].Logprob)
+	assert.GreaterOrEqual(t, res.Choices[1].Logprob, res.Choices[2].Logprob)
+
+	// beam search does not sample
+	again, err := chatglm.Generate("把这句话翻译成英文：今天天气很好。", SetMaxLength(64), SetNumBeams(3))
+	assert.NoError(t, err)
+	assert.Equal(t, res.Text, again)
+}
+
+func TestGrammar(t *testing.T) {
+	messages := []*ChatMessage{NewUserMsg("北京是中国的首都吗？只回答是或否")}
+	res, err := chatglm.Chat(messages, SetGrammar(`/(是|否)/`))
+	assert.NoError(t, err)
+	assert.Contains(t, []string{"是", "否"}, res)
+
+	// text spelling special tokens like sop and eop is kept
+	res, err = chatglm.Chat(messages, SetGrammar(`/people shop eop/`))
+	assert.NoError(t, err)
+	assert.Equal(t, "people shop eop", res)
+
+	grammar := `
+root   ::= "{" ws "\"city\":" ws string ws "," ws "\"population\":" ws [0-9]+ ws "}"
+string ::= "\"" [^"\\]* "\""
+ws     ::= [ \t\n]*
+`
+	res, err = chatglm.Chat([]*ChatMessage{NewUserMsg("用JSON描述北京的人口")}, SetGrammar(grammar), SetMaxLength(256))
+	assert.NoError(t, err)
+	assert.Regexp(t, `^\{\s*"city":\s*"[^"]*"\s*,\s*"population":\s*[0-9]+\s*\}$`, res)
+
+	_, err = chatglm.Chat(messages, SetGrammar(`root ::= undefined`))
+	assert.ErrorIs(t, err, ErrInvalidGrammar)
+}
+
+func TestChatJSON(t *testing.T) {
+	type city struct {
+		Name       string   `json:"name" description:"城市名"`
+		Population int      `json:"population"`
+		Climate    string   `json:"climate" enum:"温带,亚热带,热带"`
+		Landmarks  []string `json:"landmarks,omitempty"`
+	}
+	schema, err := JSONSchema(&city{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"name", "population", "climate"}, schema.Required)
+	assert.Equal(t, "integer", schema.Properties["population"].Type)
+	assert.Equal(t, []any{"温带", "亚热带", "热带"}, schema.Properties["climate"].Enum)
+	assert.Error(t, schema.Validate(map[string]any{"name": "北京", "population": 1.5, "climate": "温带"}))
+
+	var out city
+	err = chatglm.ChatJSON(context.Background(), []*ChatMessage{NewUserMsg("介绍一下北京")}, &out, SetMaxLength(512))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, out.Name)
+	assert.Contains(t, []string{"温带", "亚热带", "热带"}, out.Climate)
+
+	// the grammar bounds arrays like Validate, a fixed-length array gets exactly its items
+	var pair struct {
+		Numbers [2]int `json:"numbers"`
+	}
+	pairSchema, err := JSONSchema(&pair)
+	assert.NoError(t, err)
+	assert.Contains(t, pairSchema.Grammar(), `{1,1}`)
+	err = chatglm.ChatJSON(context.Background(), []*ChatMessage{NewUserMsg("随便给出几个数字")}, &pair)
+	assert.NoError(t, err)
+
+	// values spelling special tokens like sop and eop are decoded intact
+	var label struct {
+		Label string `json:"label" enum:"people,eop,sop"`
+	}
+	err = chatglm.ChatJSON(context.Background(), []*ChatMessage{NewUserMsg("医生属于哪一类")}, &label)
+	assert.NoError(t, err)
+	assert.Contains(t, []string{"people", "eop", "sop"}, label.Label)
+
+	err = chatglm.ChatJSON(context.Background(), []*ChatMessage{NewUserMsg("介绍一下北京")}, out)
+	assert.ErrorIs(t, err, ErrInvalidJSON)
+}
+
+func TestStreamChatChan(t *testing.T) {
+	messages := []*ChatMessage{NewUserMsg("2+2等于多少")}
+	events, err := chatglm.StreamChatChan(context.Background(), messages)
+	assert.NoError(t, err)
+
+	out := strings.Builder{}
+	var ids []int
+	var final StreamEvent
+	for event := range events {
+		if event.Done {
+			final = event
+			continue
+		}
+		out.WriteString(event.Text)
+		ids = append(ids, event.TokenIds...)
+	}
+	assert.True(t, final.Done)
+	assert.NoError(t, final.Err)
+	assert.Equal(t, FinishStop, final.FinishReason)
+	assert.Equal(t, len(ids), final.Usage.CompletionTokens)
+	assert.Greater(t, final.Usage.PromptTokens, 0)
+	assert.Contains(t, out.String(), "4")
+
+	seqOut := strings.Builder{}
+	for text, err := range chatglm.StreamChatSeq(context.Background(), messages) {
+		assert.NoError(t, err)
+		seqOut.WriteString(text)
+	}
+	assert.Contains(t, seqOut.String(), "4")
+}
+
+func TestChatContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var messages []*ChatMessage
+	messages = append(messages, NewUserMsg("写一篇关于春天的文章"))
+	chunks := 0
+	_, err := chatglm.StreamChatContext(ctx, messages, SetStreamCallback(func(s string) bool {
+		chunks++
+		cancel()
+		return true
+	}))
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, err, ErrCancelled)
+	assert.LessOrEqual(t, chunks, 2)
+
+	_, err = chatglm.ChatContext(ctx, messages)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestErrors(t *testing.T) {
+	_, err := New("not-exist-model.bin")
+	assert.ErrorIs(t, err, ErrModelLoad)
+	var chatglmErr *Error
+	assert.ErrorAs(t, err, &chatglmErr)
+	assert.NotEmpty(t, chatglmErr.Message)
+
+	_, err = chatglm.Chat([]*ChatMessage{NewUserMsg("你好"), NewUserMsg("你好")})
+	assert.ErrorIs(t, err, ErrInvalidMessages)
+
+	_, err = chatglm.Generate("写一篇关于春天的文章", SetMaxLength(4))
+	assert.ErrorIs(t, err, ErrContextOverflow)
+
+	_, err = chatglm.Generate("你好", SetMaxLength(1<<20))
+	assert.ErrorIs(t, err, ErrContextOverflow)
+}
+
 func TestEmbedding(t *testing.T) {
 	maxLength := 1024
 	embeddings, err := chatglm.Embeddings("你好", SetMaxLength(maxLength))
@@ -117,6 +478,95 @@ func TestEmbedding(t *testing.T) {
 	assert.Len(t, embeddings, maxLength)
 }
 
+func TestTokenize(t *testing.T) {
+	ids, err := chatglm.Tokenize("你好，世界")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, ids)
+	assert.NotContains(t, ids, 0)
+
+	count, err := chatglm.CountTokens("你好，世界")
+	assert.NoError(t, err)
+	assert.Equal(t, len(ids), count)
+
+	text, err := chatglm.Detokenize(ids)
+	assert.NoError(t, err)
+	assert.Equal(t, "你好，世界", text)
+
+	if modelType == "ChatGLM3" {
+		piece, err := chatglm.TokenToPiece(ids[0])
+		assert.NoError(t, err)
+		assert.Equal(t, "[gMASK]", piece)
+	}
+	_, err = chatglm.TokenToPiece(-1)
+	assert.Error(t, err)
+}
+
+func TestRenderPrompt(t *testing.T) {
+	messages := []*ChatMessage{NewSystemMsg("你是一个助手"), NewUserMsg("你好")}
+	text, ids, err := chatglm.RenderPrompt(messages)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, ids)
+	if modelType == "ChatGLM3" {
+		assert.Contains(t, text, "<|system|>")
+		assert.Contains(t, text, "<|user|>")
+		assert.True(t, strings.HasSuffix(text, "<|assistant|>"))
+	}
+
+	_, truncated, err := chatglm.RenderPrompt(messages, SetMaxContextLength(4))
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, len(truncated), 4)
+}
+
+func TestEmbed(t *testing.T) {
+	embed := func(text string) []float32 {
+		embedding, err := chatglm.Embed(text, SetNormalize(true))
+		assert.NoError(t, err)
+		return embedding
+	}
+	dot := func(a, b []float32) (sum float32) {
+		for i := range a {
+			sum += a[i] * b[i]
+		}
+		return sum
+	}
+
+	cat, kitten, stock := embed("猫在沙发上睡觉"), embed("小猫躺在沙发上打盹"), embed("今天股市大幅下跌")
+	assert.InDelta(t, 1, dot(cat, cat), 1e-3)
+	assert.Greater(t, dot(cat, kitten), dot(cat, stock))
+
+	last, err := chatglm.Embed("猫在沙发上睡觉", SetPooling(PoolingLast))
+	assert.NoError(t, err)
+	assert.Len(t, last, len(cat))
+}
+
+func TestNewAssistantMsg(t *testing.T) {
+	code := "interpreter\n```python\nprint(1 + 1)\n```"
+
+	// a code call starting the reply has no delimiter and no content
+	msg := NewAssistantMsg(code, "ChatGLM3")
+	require.Len(t, msg.ToolCalls, 1)
+	assert.Equal(t, TypeCode, msg.ToolCalls[0].Type)
+	assert.Equal(t, code, msg.ToolCalls[0].Code.Input)
+	assert.Empty(t, msg.Content)
+
+	msg = NewAssistantMsg("我来计算一下。"+DELIMITER+code, "ChatGLM3")
+	require.Len(t, msg.ToolCalls, 1)
+	assert.Equal(t, TypeCode, msg.ToolCalls[0].Type)
+	assert.Equal(t, code, msg.ToolCalls[0].Code.Input)
+	assert.Equal(t, "我来计算一下。", msg.Content)
+
+	msg = NewAssistantMsg("random_number_generator\n```python\ntool_call(seed=42)\n```", "ChatGLM3")
+	require.Len(t, msg.ToolCalls, 1)
+	assert.Equal(t, TypeFunction, msg.ToolCalls[0].Type)
+	assert.JSONEq(t, `{"seed": 42}`, msg.ToolCalls[0].Function.Arguments)
+
+	msg = NewAssistantMsg("interpreter 是解释器", "ChatGLM3")
+	assert.Empty(t, msg.ToolCalls)
+	msg = NewAssistantMsg(code, "ChatGLM2")
+	assert.Empty(t, msg.ToolCalls)
+	assert.Equal(t, code, msg.Content)
+}
+
 func TestSystemToolCall(t *testing.T) {
 	file, err := os.ReadFile("examples/system/function_call.txt")
 	if err != nil {
@@ -131,7 +581,14 @@ func TestSystemToolCall(t *testing.T) {
 		assert.Fail(t, "call system tool failed.")
 	}
 	assert.Contains(t, ret, "```python\ntool_call(seed=42, range=(0, 100))\n```")
-	messages = append(messages, NewAssistantMsg(ret, modelType))
+	msg := NewAssistantMsg(ret, modelType)
+	if modelType == "ChatGLM3" {
+		assert.Len(t, msg.ToolCalls, 1)
+		assert.Equal(t, TypeFunction, msg.ToolCalls[0].Type)
+		assert.Equal(t, "random_number_generator", msg.ToolCalls[0].Function.Name)
+		assert.JSONEq(t, `{"seed": 42, "range": [0, 100]}`, msg.ToolCalls[0].Function.Arguments)
+	}
+	messages = append(messages, msg)
 	messages = append(messages, NewObservationMsg("22"))
 
 	ret, err = chatglm.Chat(messages, SetDoSample(false))
@@ -141,6 +598,165 @@ func TestSystemToolCall(t *testing.T) {
 	assert.Contains(t, ret, "22")
 }
 
+func TestToolRegistry(t *testing.T) {
+	type randomArgs struct {
+		Seed  int    `json:"seed" description:"The random seed used by the generator"`
+		Range [2]int `json:"range" description:"The range of the generated numbers"`
+	}
+	registry := NewToolRegistry()
+	err := registry.RegisterFunc("random_number_generator", "Generates a random number x, s.t. range[0] <= x < range[1]",
+		func(args randomArgs) (int, error) {
+			return args.Range[0] + args.Seed%(args.Range[1]-args.Range[0]), nil
+		})
+	assert.NoError(t, err)
+
+	var schema Schema
+	err = json.Unmarshal([]byte(`{"type": "object", "required": ["city_name"], "properties": {
+		"city_name": {"type": "string", "description": "The name of the city to be queried"}}}`), &schema)
+	assert.NoError(t, err)
+	weather, err := NewSchemaTool("get_weather", "Get the current weather for `city_name`", &schema,
+		func(ctx context.Context, arguments string) (string, error) {
+			return `{"weather": "sunny"}`, nil
+		})
+	assert.NoError(t, err)
+	assert.NoError(t, registry.Register(weather))
+	assert.ErrorIs(t, registry.Register(weather), ErrInvalidTool)
+
+	file, err := os.ReadFile("examples/system/function_call.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, string(file), registry.SystemPrompt())
+
+	out, err := registry.Call(context.Background(), &FunctionMessage{Name: "random_number_generator", Arguments: `{"seed": 42, "range": [0, 100]}`})
+	assert.NoError(t, err)
+	assert.Equal(t, "42", out)
+	_, err = registry.Call(context.Background(), &FunctionMessage{Name: "get_weather", Arguments: `{}`})
+	assert.ErrorIs(t, err, ErrInvalidJSON)
+	_, err = registry.Call(context.Background(), &FunctionMessage{Name: "search"})
+	assert.ErrorIs(t, err, ErrUnknownTool)
+
+	// a tool without arguments renders an empty params list
+	clock := NewToolRegistry()
+	err = clock.RegisterFunc("get_time", "Get the current time", func(struct{}) (string, error) {
+		return "12:00", nil
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, clock.SystemPrompt(), `"params": []`)
+	out, err = clock.Call(context.Background(), &FunctionMessage{Name: "get_time", Arguments: `{}`})
+	assert.NoError(t, err)
+	assert.Equal(t, "12:00", out)
+}
+
+func TestAgent(t *testing.T) {
+	if modelType != "ChatGLM3" {
+		return
+	}
+	type randomArgs struct {
+		Seed  int    `json:"seed" description:"The random seed used by the generator"`
+		Range [2]int `json:"range" description:"The range of the generated numbers"`
+	}
+	registry := NewToolRegistry()
+	err := registry.RegisterFunc("random_number_generator", "Generates a random number x, s.t. range[0] <= x < range[1]",
+		func(args randomArgs) (int, error) {
+			return 22, nil
+		})
+	assert.NoError(t, err)
+
+	var approved []string
+	agent := NewAgent(chatglm, registry)
+	agent.Options = []GenerationOption{SetDoSample(false)}
+	agent.Timeout = time.Minute
+	agent.Approve = func(ctx context.Context, call *ToolCallMessage) error {
+		approved = append(approved, call.Function.Name)
+		return nil
+	}
+	res, err := agent.Run(context.Background(), []*ChatMessage{NewUserMsg("生成一个随机数")})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"random_number_generator"}, approved)
+	assert.Len(t, res.Steps, 2)
+	assert.Equal(t, "22", res.Steps[0].Observation)
+	assert.Contains(t, res.Answer, "22")
+	assert.Len(t, res.Messages, 5)
+
+	agent.MaxSteps = 1
+	agent.Approve = func(ctx context.Context, call *ToolCallMessage) error {
+		return errors.New("not allowed")
+	}
+	res, err = agent.Run(context.Background(), []*ChatMessage{NewUserMsg("生成一个随机数")})
+	assert.ErrorIs(t, err, ErrMaxSteps)
+	assert.ErrorIs(t, res.Steps[0].Err, ErrToolRejected)
+}
+
+func TestAgentCodeInterpreter(t *testing.T) {
+	if modelType != "ChatGLM3" || runtime.GOOS == "windows" {
+		return
+	}
+	if _, err := exec.LookPath("python3"); err != nil {
+		return
+	}
+	file, err := os.ReadFile("examples/system/code_interpreter.txt")
+	assert.NoError(t, err)
+
+	executor := &recordingExecutor{CodeExecutor: &LocalExecutor{WorkDir: t.TempDir(), Timeout: 10 * time.Second}}
+	agent := NewAgent(chatglm, NewToolRegistry())
+	agent.Executor = executor
+	agent.Options = []GenerationOption{SetDoSample(false)}
+	res, err := agent.Run(context.Background(), []*ChatMessage{NewSystemMsg(string(file)), NewUserMsg("用python打印100以内的所有质数")})
+	assert.NoError(t, err)
+	require.GreaterOrEqual(t, len(res.Steps), 2)
+	assert.NotEmpty(t, res.Answer)
+
+	// the code of the reply ran in python and its output went back to the model as the observation
+	require.Len(t, res.Steps[0].Reply.ToolCalls, 1)
+	assert.Equal(t, TypeCode, res.Steps[0].Reply.ToolCalls[0].Type)
+	assert.NoError(t, res.Steps[0].Err)
+	require.NotEmpty(t, executor.results)
+	assert.Equal(t, 0, executor.results[0].ExitCode)
+	assert.Equal(t, executor.results[0].Observation(), res.Steps[0].Observation)
+	assert.Contains(t, res.Messages, NewObservationMsg(res.Steps[0].Observation))
+}
+
+// recordingExecutor keep the results of the code it runs
+type recordingExecutor struct {
+	CodeExecutor
+	results []*ExecutionResult
+}
+
+func (e *recordingExecutor) Execute(ctx context.Context, code string) (*ExecutionResult, error) {
+	result, err := e.CodeExecutor.Execute(ctx, code)
+	if result != nil {
+		e.results = append(e.results, result)
+	}
+	return result, err
+}
+
+func TestLocalExecutor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	executor := &LocalExecutor{Interpreter: "sh", WorkDir: t.TempDir() + "/data", Timeout: time.Second, MemoryBytes: 512 << 20}
+	res, err := executor.Execute(context.Background(), codeBlock("interpreter\n```sh\necho hello; echo oops >&2; echo 1 > out.txt; exit 3\n```"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", res.Stdout)
+	assert.Equal(t, "oops\n", res.Stderr)
+	assert.Equal(t, 3, res.ExitCode)
+	assert.Equal(t, []string{"out.txt"}, res.Artifacts)
+	assert.Contains(t, res.Observation(), "[exit status 3]")
+
+	executor.Timeout = 100 * time.Millisecond
+	res, err = executor.Execute(context.Background(), "sleep 5")
+	assert.NoError(t, err)
+	assert.True(t, res.TimedOut)
+	assert.Less(t, res.Duration, 5*time.Second)
+
+	executor.Timeout = 10 * time.Second
+	executor.CPUTime = time.Second
+	res, err = executor.Execute(context.Background(), "while :; do :; done")
+	assert.NoError(t, err)
+	assert.True(t, res.CPUTimeExceeded)
+	assert.False(t, res.TimedOut)
+	assert.Contains(t, res.Observation(), "[CPU time limit exceeded]")
+}
+
 func TestCodeInterpreter(t *testing.T) {
 	file, err := os.ReadFile("examples/system/code_interpreter.txt")
 	if err != nil {
@@ -154,7 +770,11 @@ func TestCodeInterpreter(t *testing.T) {
 		assert.Fail(t, "call code interpreter failed.")
 	}
 	msg := NewAssistantMsg(ret, modelType)
-	msg.ToolCalls = append(msg.ToolCalls, &ToolCallMessage{Type: TypeCode, Code: &CodeMessage{Input: "```python\ndef is_prime(n):\n    \"\"\"Check if a number is prime.\"\"\"\n    if n <= 1:\n        return False\n    if n <= 3:\n        return True\n    if n % 2 == 0 or n % 3 == 0:\n        return False\n    i = 5\n    while i * i <= n:\n        if n % i == 0 or n % (i + 2) == 0:\n            return False\n        i += 6\n    return True\n\n# Get all prime numbers up to 100\nprimes_upto_100 = [i for i in range(2, 101) if is_prime(i)]\nprimes_upto_100\n```"}})
+	if modelType == "ChatGLM3" {
+		require.Len(t, msg.ToolCalls, 1)
+		assert.Equal(t, TypeCode, msg.ToolCalls[0].Type)
+		assert.Contains(t, codeBlock(msg.ToolCalls[0].Code.Input), "def is_prime(n):")
+	}
 	messages = append(messages, msg)
 	assert.Contains(t, ret, "好的，我会为您列出100以内的所有质数。\n\n质数是指只能被1和它本身整除的大于1的整数。例如，2、3、5、7等都是质数。\n\n让我们开始吧！")
 	messages = append(messages, NewObservationMsg("[2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53, 59, 61, 67, 71, 73, 79, 83, 89, 97]"))
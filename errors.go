@@ -0,0 +1,63 @@
+package chatglm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrModelLoad the model file could not be loaded
+	ErrModelLoad = errors.New("failed loading model")
+	// ErrModelFreed the model was released by Free
+	ErrModelFreed = errors.New("model is freed")
+	// ErrContextOverflow prompt and generation do not fit in max_length
+	ErrContextOverflow = errors.New("context overflow")
+	// ErrInvalidMessages chat messages are malformed
+	ErrInvalidMessages = errors.New("invalid chat messages")
+	// ErrInvalidGrammar the grammar of SetGrammar can not be parsed or used
+	ErrInvalidGrammar = errors.New("invalid grammar")
+	// ErrInvalidJSON the output of ChatJSON does not match the schema of its target, or the target has no schema
+	ErrInvalidJSON = errors.New("invalid JSON")
+	// ErrInvalidTool a tool can not be created or registered
+	ErrInvalidTool = errors.New("invalid tool")
+	// ErrUnknownTool the model called a tool which is not registered
+	ErrUnknownTool = errors.New("unknown tool")
+	// ErrToolRejected the approval hook of an Agent rejected a tool call
+	ErrToolRejected = errors.New("tool call rejected")
+	// ErrMaxSteps the model still called tools after the maximum number of agent steps
+	ErrMaxSteps = errors.New("agent reached max steps")
+	// ErrCancelled generation stopped because the context is done, the error also matches ctx.Err()
+	ErrCancelled = errors.New("generation cancelled")
+	// ErrStopped is returned together with the text generated so far
+	// when the stream callback returns false
+	ErrStopped = errors.New("generation stopped by stream callback")
+)
+
+// Error is a failure inside chatglm.cpp, Message holds the C++ exception message
+// and Err the sentinel it matches, if any
+type Error struct {
+	Op      string
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	msg := e.Op + " failed"
+	if e.Err != nil {
+		msg = e.Err.Error()
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// cancelledError matches both ErrCancelled and ctx.Err()
+func cancelledError(ctx context.Context) error {
+	return fmt.Errorf("%w: %w", ErrCancelled, ctx.Err())
+}
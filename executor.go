@@ -0,0 +1,245 @@
+package chatglm
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultMaxOutput bound the stdout and stderr kept by LocalExecutor when MaxOutput is 0
+const DefaultMaxOutput = 64 << 10
+
+// CodeExecutor run the code of a ChatGLM3 code interpreter tool call
+type CodeExecutor interface {
+	// Execute run code, a failing program is reported in the result, the error is for
+	// code which could not be run at all
+	Execute(ctx context.Context, code string) (*ExecutionResult, error)
+}
+
+// ExecutionResult is the output of code run by a CodeExecutor
+type ExecutionResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	// TimedOut is set when the code was killed for exceeding the time limit,
+	// CPUTimeExceeded when it was killed for exceeding the CPU time limit
+	TimedOut        bool
+	CPUTimeExceeded bool
+	// Artifacts are the files the code created or modified, relative to the working directory
+	Artifacts []string
+	Duration  time.Duration
+}
+
+// Observation format the result for the model
+func (r *ExecutionResult) Observation() string {
+	var out strings.Builder
+	out.WriteString(r.Stdout)
+	if r.Stderr != "" {
+		if out.Len() > 0 && !strings.HasSuffix(out.String(), "\n") {
+			out.WriteString("\n")
+		}
+		out.WriteString(r.Stderr)
+	}
+	var notes []string
+	if r.TimedOut {
+		notes = append(notes, "execution timed out")
+	} else if r.CPUTimeExceeded {
+		notes = append(notes, "CPU time limit exceeded")
+	} else if r.ExitCode != 0 {
+		notes = append(notes, fmt.Sprintf("exit status %d", r.ExitCode))
+	}
+	if len(r.Artifacts) > 0 {
+		notes = append(notes, "files: "+strings.Join(r.Artifacts, ", "))
+	}
+	for _, note := range notes {
+		if out.Len() > 0 && !strings.HasSuffix(out.String(), "\n") {
+			out.WriteString("\n")
+		}
+		out.WriteString("[" + note + "]")
+	}
+	return out.String()
+}
+
+// LocalExecutor run code in a subprocess of an interpreter, the code is passed as a script file.
+// It limits resources but is no sandbox, the code runs with the rights of the process
+type LocalExecutor struct {
+	// Interpreter binary, python3 when empty, Args are passed before the script
+	Interpreter string
+	Args        []string
+	// WorkDir the code runs in, created when missing, like /mnt/data of the ChatGLM3 prompt.
+	// the current directory when empty
+	WorkDir string
+	// Env of the process, the environment of this process when nil
+	Env []string
+
+	// Timeout of the wall time, CPUTime of the processor time and MemoryBytes of the address space,
+	// 0 is no limit. CPUTime and MemoryBytes are set by ulimit and are only supported on unix
+	Timeout     time.Duration
+	CPUTime     time.Duration
+	MemoryBytes int64
+	// MaxOutput bound the bytes kept of stdout and of stderr, 0 is DefaultMaxOutput
+	MaxOutput int
+}
+
+// Execute run code and collect its output and the files it wrote in WorkDir
+func (e *LocalExecutor) Execute(ctx context.Context, code string) (*ExecutionResult, error) {
+	interpreter := e.Interpreter
+	if interpreter == "" {
+		interpreter = "python3"
+	}
+	if _, err := exec.LookPath(interpreter); err != nil {
+		return nil, err
+	}
+	if e.WorkDir != "" {
+		if err := os.MkdirAll(e.WorkDir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	script, err := os.CreateTemp("", "chatglm-code-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(script.Name())
+	_, err = script.WriteString(code)
+	if closeErr := script.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	runCtx := ctx
+	if e.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, e.Timeout)
+		defer cancel()
+	}
+	args := append(append([]string{}, e.Args...), script.Name())
+	cmd, err := limitedCommand(runCtx, e.CPUTime, e.MemoryBytes, interpreter, args...)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Dir = e.WorkDir
+	cmd.Env = e.Env
+	maxOutput := e.MaxOutput
+	if maxOutput <= 0 {
+		maxOutput = DefaultMaxOutput
+	}
+	stdout, stderr := &limitedBuffer{limit: maxOutput}, &limitedBuffer{limit: maxOutput}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	// do not wait forever for pipes inherited by background children
+	cmd.WaitDelay = time.Second
+
+	before := e.snapshot()
+	start := time.Now()
+	err = cmd.Run()
+	result := &ExecutionResult{
+		Stdout:    stdout.String(),
+		Stderr:    stderr.String(),
+		Duration:  time.Since(start),
+		Artifacts: e.changedFiles(before),
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() != nil:
+		return result, cancelledError(ctx)
+	case runCtx.Err() != nil:
+		result.TimedOut = true
+		result.ExitCode = -1
+	case errors.As(err, &exitErr):
+		result.ExitCode = exitErr.ExitCode()
+		result.CPUTimeExceeded = cpuTimeExceeded(exitErr.ProcessState, e.CPUTime)
+	case err != nil && !errors.Is(err, exec.ErrWaitDelay):
+		return nil, err
+	}
+	return result, nil
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// snapshot the regular files of WorkDir, unreadable entries are skipped
+func (e *LocalExecutor) snapshot() map[string]fileState {
+	dir := e.WorkDir
+	if dir == "" {
+		dir = "."
+	}
+	files := map[string]fileState{}
+	_ = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil
+		}
+		files[filepath.ToSlash(rel)] = fileState{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	return files
+}
+
+// changedFiles list the files created or modified since before, in lexical order
+func (e *LocalExecutor) changedFiles(before map[string]fileState) []string {
+	var changed []string
+	for path, state := range e.snapshot() {
+		if old, ok := before[path]; !ok || old.size != state.size || !old.modTime.Equal(state.modTime) {
+			changed = append(changed, path)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// limitedBuffer keep the first limit bytes written and drop the rest
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		b.buf.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.buf.String() + "\n[output truncated]"
+	}
+	return b.buf.String()
+}
+
+// codeBlock extract the code of a code interpreter tool call, dropping the interpreter
+// line and the markdown fence the model writes around it
+func codeBlock(input string) string {
+	code := strings.TrimSpace(input)
+	if rest, ok := strings.CutPrefix(code, "interpreter\n"); ok {
+		code = strings.TrimSpace(rest)
+	}
+	if strings.HasPrefix(code, "```") {
+		_, code, _ = strings.Cut(code, "\n")
+		code = strings.TrimSuffix(strings.TrimSpace(code), "```")
+	}
+	return code
+}
@@ -0,0 +1,27 @@
+//go:build !unix && !windows
+
+package chatglm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// limitedCommand run name, only the timeout of the context applies, CPU time and memory
+// limits are not supported without ulimit
+func limitedCommand(ctx context.Context, cpuTime time.Duration, memoryBytes int64, name string,
+	args ...string) (*exec.Cmd, error) {
+	if cpuTime > 0 || memoryBytes > 0 {
+		return nil, fmt.Errorf("CPU time and memory limits: %w", errors.ErrUnsupported)
+	}
+	return exec.CommandContext(ctx, name, args...), nil
+}
+
+// cpuTimeExceeded is always false, there is no CPU time limit without ulimit
+func cpuTimeExceeded(state *os.ProcessState, cpuTime time.Duration) bool {
+	return false
+}
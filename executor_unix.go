@@ -0,0 +1,62 @@
+//go:build unix
+
+package chatglm
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// limitedCommand run name under sh with ulimit applying the CPU time and memory limits,
+// the process gets its own group so that a timeout kills its children too
+func limitedCommand(ctx context.Context, cpuTime time.Duration, memoryBytes int64, name string,
+	args ...string) (*exec.Cmd, error) {
+	var cmd *exec.Cmd
+	if cpuTime > 0 || memoryBytes > 0 {
+		script := ""
+		if cpuTime > 0 {
+			script += fmt.Sprintf("ulimit -t %d && ", cpuLimitSeconds(cpuTime))
+		}
+		if memoryBytes > 0 {
+			script += fmt.Sprintf("ulimit -v %d && ", (memoryBytes+1023)/1024)
+		}
+		script += `exec "$@"`
+		cmd = exec.CommandContext(ctx, "/bin/sh", append([]string{"-c", script, "sh", name}, args...)...)
+	} else {
+		cmd = exec.CommandContext(ctx, name, args...)
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return cmd, nil
+}
+
+// cpuLimitSeconds is the CPU time limit of ulimit, which counts whole seconds
+func cpuLimitSeconds(cpuTime time.Duration) int64 {
+	return int64(math.Ceil(cpuTime.Seconds()))
+}
+
+// cpuTimeExceeded report whether the process was killed by the CPU time limit of ulimit, the kernel
+// sends SIGXCPU at the soft limit and SIGKILL at the hard one, which ulimit sets to the same value.
+// the CPU time of the rusage is sampled and may stay a little below the limit
+func cpuTimeExceeded(state *os.ProcessState, cpuTime time.Duration) bool {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if cpuTime <= 0 || !ok || !status.Signaled() {
+		return false
+	}
+	switch status.Signal() {
+	case syscall.SIGXCPU:
+		return true
+	case syscall.SIGKILL:
+		limit := time.Duration(cpuLimitSeconds(cpuTime)) * time.Second
+		return state.UserTime()+state.SystemTime() >= limit*9/10
+	}
+	return false
+}
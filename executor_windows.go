@@ -0,0 +1,26 @@
+//go:build windows
+
+package chatglm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// limitedCommand run name, CPU time and memory limits are not supported on windows
+func limitedCommand(ctx context.Context, cpuTime time.Duration, memoryBytes int64, name string,
+	args ...string) (*exec.Cmd, error) {
+	if cpuTime > 0 || memoryBytes > 0 {
+		return nil, fmt.Errorf("CPU time and memory limits: %w", errors.ErrUnsupported)
+	}
+	return exec.CommandContext(ctx, name, args...), nil
+}
+
+// cpuTimeExceeded is always false, there is no CPU time limit on windows
+func cpuTimeExceeded(state *os.ProcessState, cpuTime time.Duration) bool {
+	return false
+}
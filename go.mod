@@ -1,6 +1,6 @@
 module github.com/Weaxs/go-chatglm.cpp
 
-go 1.21
+go 1.23
 
 require github.com/stretchr/testify v1.8.4
 
@@ -0,0 +1,831 @@
+package chatglm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// runeRange is an inclusive range of characters
+type runeRange struct {
+	lo, hi rune
+}
+
+// grammarElement matches a single character of ranges, or the rule it references when rule >= 0
+type grammarElement struct {
+	rule   int
+	ranges []runeRange
+	negate bool
+}
+
+func charElement(ranges []runeRange, negate bool) grammarElement {
+	return grammarElement{rule: -1, ranges: ranges, negate: negate}
+}
+
+func refElement(rule int) grammarElement {
+	return grammarElement{rule: rule}
+}
+
+func (e grammarElement) match(r rune) bool {
+	for _, rg := range e.ranges {
+		if r >= rg.lo && r <= rg.hi {
+			return !e.negate
+		}
+	}
+	return e.negate
+}
+
+// overlap report whether any character of [lo, hi] may match
+func (e grammarElement) overlap(lo, hi rune) bool {
+	if e.negate {
+		for _, rg := range e.ranges {
+			if rg.lo <= lo && hi <= rg.hi {
+				return false
+			}
+		}
+		return true
+	}
+	for _, rg := range e.ranges {
+		if rg.lo <= hi && lo <= rg.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// grammar is a list of rules, every rule is a list of alternative sequences of elements.
+// groups and repetitions are rewritten into rules of their own, so matching only knows
+// characters and rule references
+type grammar struct {
+	rules [][][]grammarElement
+	root  int
+
+	// stacks and states are interned, so that equal states share their transitions
+	stacks map[stackKey]*grammarStack
+	states map[string]*grammarState
+}
+
+func newGrammar() *grammar {
+	return &grammar{stacks: map[stackKey]*grammarStack{}, states: map[string]*grammarState{}}
+}
+
+func (g *grammar) newRule(alternatives [][]grammarElement) int {
+	g.rules = append(g.rules, alternatives)
+	return len(g.rules) - 1
+}
+
+// group turn a sequence into a single element
+func (g *grammar) group(seq []grammarElement) grammarElement {
+	if len(seq) == 1 {
+		return seq[0]
+	}
+	return refElement(g.newRule([][]grammarElement{seq}))
+}
+
+// repeat e between minCount and maxCount times, maxCount < 0 is unbounded
+func (g *grammar) repeat(e grammarElement, minCount, maxCount int) []grammarElement {
+	seq := make([]grammarElement, 0, minCount+1)
+	for i := 0; i < minCount; i++ {
+		seq = append(seq, e)
+	}
+	if maxCount < 0 {
+		// star ::= e star |
+		star := g.newRule(nil)
+		g.rules[star] = [][]grammarElement{{e, refElement(star)}, {}}
+		return append(seq, refElement(star))
+	}
+	// optional ::= e optional |, nested so that every count has a single parse
+	next := -1
+	for i := minCount; i < maxCount; i++ {
+		alt := []grammarElement{e}
+		if next >= 0 {
+			alt = append(alt, refElement(next))
+		}
+		next = g.newRule([][]grammarElement{alt, {}})
+	}
+	if next >= 0 {
+		seq = append(seq, refElement(next))
+	}
+	return seq
+}
+
+// parseGrammarOption parse the grammar of SetGrammar, a regular expression between slashes or GBNF
+func parseGrammarOption(src string) (*grammar, error) {
+	trimmed := strings.TrimSpace(src)
+	if len(trimmed) >= 2 && strings.HasPrefix(trimmed, "/") && strings.HasSuffix(trimmed, "/") {
+		return parseRegex(trimmed[1 : len(trimmed)-1])
+	}
+	return parseGBNF(src)
+}
+
+// grammarParser holds the input shared by the GBNF and regular expression parsers
+type grammarParser struct {
+	src string
+	pos int
+	g   *grammar
+}
+
+func (p *grammarParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: offset %d: %s", ErrInvalidGrammar, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *grammarParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *grammarParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *grammarParser) next() (rune, error) {
+	if p.eof() {
+		return 0, p.errorf("unexpected end")
+	}
+	r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+	p.pos += size
+	return r, nil
+}
+
+// escape parse the character after a backslash
+func (p *grammarParser) escape() (rune, error) {
+	r, err := p.next()
+	if err != nil {
+		return 0, err
+	}
+	switch r {
+	case 'n':
+		return '\n', nil
+	case 'r':
+		return '\r', nil
+	case 't':
+		return '\t', nil
+	case 'f':
+		return '\f', nil
+	case 'v':
+		return '\v', nil
+	case 'x':
+		return p.hex(2)
+	case 'u':
+		return p.hex(4)
+	case 'U':
+		return p.hex(8)
+	}
+	return r, nil
+}
+
+func (p *grammarParser) hex(digits int) (rune, error) {
+	if p.pos+digits > len(p.src) {
+		return 0, p.errorf("expected %d hex digits", digits)
+	}
+	v, err := strconv.ParseUint(p.src[p.pos:p.pos+digits], 16, 32)
+	if err != nil {
+		return 0, p.errorf("expected %d hex digits", digits)
+	}
+	p.pos += digits
+	return rune(v), nil
+}
+
+// class parse a character class after [, backslash shorthands are expanded by shorthand
+func (p *grammarParser) class(shorthand func(r rune) ([]runeRange, bool)) (grammarElement, error) {
+	negate := false
+	if p.peek() == '^' {
+		negate = true
+		p.pos++
+	}
+	var ranges []runeRange
+	for first := true; first || p.peek() != ']'; first = false {
+		lo, err := p.next()
+		if err != nil {
+			return grammarElement{}, err
+		}
+		if lo == '\\' {
+			if lo, err = p.next(); err != nil {
+				return grammarElement{}, err
+			}
+			if expanded, ok := shorthand(lo); ok {
+				ranges = append(ranges, expanded...)
+				continue
+			}
+			p.pos -= utf8.RuneLen(lo)
+			if lo, err = p.escape(); err != nil {
+				return grammarElement{}, err
+			}
+		}
+		hi := lo
+		if p.peek() == '-' && p.pos+1 < len(p.src) && p.src[p.pos+1] != ']' {
+			p.pos++
+			if hi, err = p.next(); err != nil {
+				return grammarElement{}, err
+			}
+			if hi == '\\' {
+				if hi, err = p.escape(); err != nil {
+					return grammarElement{}, err
+				}
+			}
+			if hi < lo {
+				return grammarElement{}, p.errorf("invalid range %q-%q", lo, hi)
+			}
+		}
+		ranges = append(ranges, runeRange{lo, hi})
+	}
+	p.pos++
+	return charElement(ranges, negate), nil
+}
+
+// counted parse {n}, {n,} or {n,m} after {
+func (p *grammarParser) counted() (int, int, error) {
+	end := strings.IndexByte(p.src[p.pos:], '}')
+	if end < 0 {
+		return 0, 0, p.errorf("missing }")
+	}
+	body := p.src[p.pos : p.pos+end]
+	p.pos += end + 1
+	minText, maxText, ranged := strings.Cut(body, ",")
+	minCount, err := strconv.Atoi(strings.TrimSpace(minText))
+	if err != nil || minCount < 0 {
+		return 0, 0, p.errorf("invalid repetition {%s}", body)
+	}
+	if !ranged {
+		return minCount, minCount, nil
+	}
+	if strings.TrimSpace(maxText) == "" {
+		return minCount, -1, nil
+	}
+	maxCount, err := strconv.Atoi(strings.TrimSpace(maxText))
+	if err != nil || maxCount < minCount {
+		return 0, 0, p.errorf("invalid repetition {%s}", body)
+	}
+	return minCount, maxCount, nil
+}
+
+// quantify apply a *, +, ? or {n,m} after the atom, report whether there was one
+func (p *grammarParser) quantify(atom []grammarElement) ([]grammarElement, bool, error) {
+	var minCount, maxCount int
+	switch p.peek() {
+	case '*':
+		minCount, maxCount = 0, -1
+	case '+':
+		minCount, maxCount = 1, -1
+	case '?':
+		minCount, maxCount = 0, 1
+	case '{':
+		p.pos++
+		var err error
+		if minCount, maxCount, err = p.counted(); err != nil {
+			return nil, false, err
+		}
+		return p.g.repeat(p.g.group(atom), minCount, maxCount), true, nil
+	default:
+		return atom, false, nil
+	}
+	p.pos++
+	return p.g.repeat(p.g.group(atom), minCount, maxCount), true, nil
+}
+
+// gbnfParser parse the GBNF grammars of llama.cpp: rules `name ::= alternatives`, "literals",
+// [character classes], (groups), rule references, . for any character, the *, +, ? and {n,m}
+// repetitions, and # comments. the grammar starts at the rule root
+type gbnfParser struct {
+	grammarParser
+	names   map[string]int
+	defined map[string]bool
+}
+
+func parseGBNF(src string) (*grammar, error) {
+	p := &gbnfParser{
+		grammarParser: grammarParser{src: src, g: newGrammar()},
+		names:         map[string]int{},
+		defined:       map[string]bool{},
+	}
+	for p.skipSpace(); !p.eof(); p.skipSpace() {
+		name := p.name()
+		if name == "" {
+			return nil, p.errorf("expected rule name")
+		}
+		p.skipSpace()
+		if !strings.HasPrefix(p.src[p.pos:], "::=") {
+			return nil, p.errorf("expected ::= after %s", name)
+		}
+		p.pos += 3
+		if p.defined[name] {
+			return nil, p.errorf("rule %s is defined twice", name)
+		}
+		alternatives, err := p.alternatives(false)
+		if err != nil {
+			return nil, err
+		}
+		p.g.rules[p.rule(name)] = alternatives
+		p.defined[name] = true
+	}
+
+	for name := range p.names {
+		if !p.defined[name] {
+			return nil, fmt.Errorf("%w: rule %s is not defined", ErrInvalidGrammar, name)
+		}
+	}
+	root, ok := p.names["root"]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing root rule", ErrInvalidGrammar)
+	}
+	p.g.root = root
+	return p.g, nil
+}
+
+func (p *gbnfParser) skipSpace() {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isNameByte(c byte) bool {
+	return c == '-' || c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func (p *gbnfParser) name() string {
+	start := p.pos
+	for !p.eof() && isNameByte(p.peek()) {
+		p.pos++
+	}
+	return p.src[start:p.pos]
+}
+
+// rule return the index of the named rule, referenced rules may be defined later
+func (p *gbnfParser) rule(name string) int {
+	if i, ok := p.names[name]; ok {
+		return i
+	}
+	i := p.g.newRule(nil)
+	p.names[name] = i
+	return i
+}
+
+// ruleStart report whether a rule definition `name ::=` starts at the current position
+func (p *gbnfParser) ruleStart() bool {
+	start := p.pos
+	defer func() { p.pos = start }()
+	if p.name() == "" {
+		return false
+	}
+	p.skipSpace()
+	return strings.HasPrefix(p.src[p.pos:], "::=")
+}
+
+// alternatives parse until the next rule definition, or the closing ) of a group
+func (p *gbnfParser) alternatives(inGroup bool) ([][]grammarElement, error) {
+	alternatives := [][]grammarElement{nil}
+	for {
+		p.skipSpace()
+		if p.eof() || (!inGroup && p.ruleStart()) {
+			if inGroup {
+				return nil, p.errorf("missing )")
+			}
+			return alternatives, nil
+		}
+
+		var atom []grammarElement
+		switch c := p.peek(); {
+		case c == '|':
+			p.pos++
+			alternatives = append(alternatives, nil)
+			continue
+		case c == ')':
+			if !inGroup {
+				return nil, p.errorf("unexpected )")
+			}
+			p.pos++
+			return alternatives, nil
+		case c == '"':
+			p.pos++
+			for p.peek() != '"' {
+				r, err := p.next()
+				if err != nil {
+					return nil, err
+				}
+				if r == '\\' {
+					if r, err = p.escape(); err != nil {
+						return nil, err
+					}
+				}
+				atom = append(atom, charElement([]runeRange{{r, r}}, false))
+			}
+			p.pos++
+			if len(atom) == 0 {
+				continue
+			}
+		case c == '[':
+			p.pos++
+			element, err := p.class(func(rune) ([]runeRange, bool) { return nil, false })
+			if err != nil {
+				return nil, err
+			}
+			atom = []grammarElement{element}
+		case c == '.':
+			p.pos++
+			atom = []grammarElement{charElement(nil, true)}
+		case c == '(':
+			p.pos++
+			group, err := p.alternatives(true)
+			if err != nil {
+				return nil, err
+			}
+			atom = []grammarElement{refElement(p.g.newRule(group))}
+		case isNameByte(c):
+			atom = []grammarElement{refElement(p.rule(p.name()))}
+		default:
+			return nil, p.errorf("unexpected %q", c)
+		}
+
+		seq, _, err := p.quantify(atom)
+		if err != nil {
+			return nil, err
+		}
+		last := len(alternatives) - 1
+		alternatives[last] = append(alternatives[last], seq...)
+	}
+}
+
+// parseRegex parse a regular expression which the whole output must match: literals, escapes,
+// \d \w \s and their negations, [character classes], . for any character but newline,
+// (groups), (?:groups), | and the *, +, ? and {n,m} repetitions, ^ and $ anchors are implied
+func parseRegex(src string) (*grammar, error) {
+	src = strings.TrimPrefix(src, "^")
+	if strings.HasSuffix(src, "$") && !strings.HasSuffix(src, `\$`) {
+		src = strings.TrimSuffix(src, "$")
+	}
+	p := &grammarParser{src: src, g: newGrammar()}
+	alternatives, err := regexAlternatives(p, false)
+	if err != nil {
+		return nil, err
+	}
+	p.g.root = p.g.newRule(alternatives)
+	return p.g, nil
+}
+
+var (
+	digitRanges = []runeRange{{'0', '9'}}
+	wordRanges  = []runeRange{{'0', '9'}, {'A', 'Z'}, {'_', '_'}, {'a', 'z'}}
+	spaceRanges = []runeRange{{'\t', '\r'}, {' ', ' '}}
+)
+
+// regexShorthand expand \d, \w and \s, which may appear in classes
+func regexShorthand(r rune) ([]runeRange, bool) {
+	switch r {
+	case 'd':
+		return digitRanges, true
+	case 'w':
+		return wordRanges, true
+	case 's':
+		return spaceRanges, true
+	}
+	return nil, false
+}
+
+func regexAlternatives(p *grammarParser, inGroup bool) ([][]grammarElement, error) {
+	alternatives := [][]grammarElement{nil}
+	for {
+		if p.eof() {
+			if inGroup {
+				return nil, p.errorf("missing )")
+			}
+			return alternatives, nil
+		}
+
+		var atom []grammarElement
+		r, _ := p.next()
+		switch r {
+		case '|':
+			alternatives = append(alternatives, nil)
+			continue
+		case ')':
+			if !inGroup {
+				return nil, p.errorf("unexpected )")
+			}
+			return alternatives, nil
+		case '(':
+			if strings.HasPrefix(p.src[p.pos:], "?:") {
+				p.pos += 2
+			}
+			group, err := regexAlternatives(p, true)
+			if err != nil {
+				return nil, err
+			}
+			atom = []grammarElement{refElement(p.g.newRule(group))}
+		case '[':
+			element, err := p.class(regexShorthand)
+			if err != nil {
+				return nil, err
+			}
+			atom = []grammarElement{element}
+		case '.':
+			atom = []grammarElement{charElement([]runeRange{{'\n', '\n'}}, true)}
+		case '\\':
+			c, err := p.next()
+			if err != nil {
+				return nil, err
+			}
+			if ranges, ok := regexShorthand(c); ok {
+				atom = []grammarElement{charElement(ranges, false)}
+			} else if ranges, ok := regexShorthand(c + 'a' - 'A'); ok && 'A' <= c && c <= 'Z' {
+				atom = []grammarElement{charElement(ranges, true)}
+			} else {
+				p.pos -= utf8.RuneLen(c)
+				if c, err = p.escape(); err != nil {
+					return nil, err
+				}
+				atom = []grammarElement{charElement([]runeRange{{c, c}}, false)}
+			}
+		case '*', '+', '?', '{':
+			return nil, p.errorf("nothing to repeat before %q", r)
+		default:
+			atom = []grammarElement{charElement([]runeRange{{r, r}}, false)}
+		}
+
+		seq, quantified, err := p.quantify(atom)
+		if err != nil {
+			return nil, err
+		}
+		// lazy and possessive repetitions match the same language
+		if quantified && (p.peek() == '?' || p.peek() == '+') {
+			p.pos++
+		}
+		last := len(alternatives) - 1
+		alternatives[last] = append(alternatives[last], seq...)
+	}
+}
+
+// grammarPos points at the next element of an alternative
+type grammarPos struct {
+	rule, alt, index int
+}
+
+// grammarStack is a persistent stack of positions, stacks share their bottom and nil is the empty stack
+type grammarStack struct {
+	pos    grammarPos
+	parent *grammarStack
+	depth  int
+	id     int
+}
+
+type stackKey struct {
+	pos    grammarPos
+	parent *grammarStack
+}
+
+// maxGrammarDepth bounds the expansion of rule references, which left recursive grammars never finish
+const maxGrammarDepth = 512
+
+// grammarState is the set of parse stacks which the output so far leaves, every stack has a character
+// element on top or is empty once the grammar is complete. states are interned and never modified,
+// so token masks branch from them and remember where every byte leads
+type grammarState struct {
+	g      *grammar
+	stacks []*grammarStack
+	// incomplete utf-8 sequence at the end of the output
+	pending []byte
+	// leading spaces and newlines are trimmed from the output, they are skipped until started
+	started bool
+	// state after each byte, rejectedState when the grammar does not allow it
+	next *[256]*grammarState
+}
+
+var rejectedState = &grammarState{}
+
+func newGrammarState(g *grammar) *grammarState {
+	var stacks []*grammarStack
+	for alt := range g.rules[g.root] {
+		stacks = g.expand(stacks, g.push(nil, grammarPos{g.root, alt, 0}), 0)
+	}
+	return g.state(stacks, nil, false)
+}
+
+// state return the interned state of the stacks
+func (g *grammar) state(stacks []*grammarStack, pending []byte, started bool) *grammarState {
+	sort.Slice(stacks, func(i, j int) bool { return stackID(stacks[i]) < stackID(stacks[j]) })
+	var key strings.Builder
+	key.WriteString(strconv.FormatBool(started))
+	key.WriteString(string(pending))
+	unique := stacks[:0]
+	for i, stack := range stacks {
+		if i > 0 && stack == stacks[i-1] {
+			continue
+		}
+		unique = append(unique, stack)
+		key.WriteByte(',')
+		key.WriteString(strconv.Itoa(stackID(stack)))
+	}
+	if state, ok := g.states[key.String()]; ok {
+		return state
+	}
+	state := &grammarState{g: g, stacks: unique, pending: pending, started: started}
+	g.states[key.String()] = state
+	return state
+}
+
+func stackID(stack *grammarStack) int {
+	if stack == nil {
+		return 0
+	}
+	return stack.id
+}
+
+func (g *grammar) element(pos grammarPos) grammarElement {
+	return g.rules[pos.rule][pos.alt][pos.index]
+}
+
+// push pos onto stack, pos is dropped when its alternative has ended
+func (g *grammar) push(stack *grammarStack, pos grammarPos) *grammarStack {
+	if pos.index >= len(g.rules[pos.rule][pos.alt]) {
+		return stack
+	}
+	key := stackKey{pos, stack}
+	if interned, ok := g.stacks[key]; ok {
+		return interned
+	}
+	interned := &grammarStack{pos: pos, parent: stack, depth: 1, id: len(g.stacks) + 1}
+	if stack != nil {
+		interned.depth = stack.depth + 1
+	}
+	g.stacks[key] = interned
+	return interned
+}
+
+// expand the rule references on top of stack into stacks with a character element on top
+func (g *grammar) expand(out []*grammarStack, stack *grammarStack, depth int) []*grammarStack {
+	if stack == nil {
+		return append(out, stack)
+	}
+	if depth > maxGrammarDepth || stack.depth > maxGrammarDepth {
+		return out
+	}
+	e := g.element(stack.pos)
+	if e.rule < 0 {
+		return append(out, stack)
+	}
+	base := g.push(stack.parent, grammarPos{stack.pos.rule, stack.pos.alt, stack.pos.index + 1})
+	for alt := range g.rules[e.rule] {
+		out = g.expand(out, g.push(base, grammarPos{e.rule, alt, 0}), depth+1)
+	}
+	return out
+}
+
+func (s *grammarState) acceptRune(r rune) []*grammarStack {
+	var out []*grammarStack
+	for _, stack := range s.stacks {
+		if stack == nil || !s.g.element(stack.pos).match(r) {
+			continue
+		}
+		next := s.g.push(stack.parent, grammarPos{stack.pos.rule, stack.pos.alt, stack.pos.index + 1})
+		out = s.g.expand(out, next, 0)
+	}
+	return out
+}
+
+// mayComplete report whether the incomplete utf-8 sequence may become a character the grammar accepts
+func (s *grammarState) mayComplete(pending []byte) bool {
+	lo, hi := make([]byte, 0, utf8.UTFMax), make([]byte, 0, utf8.UTFMax)
+	lo, hi = append(lo, pending...), append(hi, pending...)
+	for !utf8.FullRune(lo) {
+		lo, hi = append(lo, 0x80), append(hi, 0xbf)
+	}
+	loRune, _ := utf8.DecodeRune(lo)
+	hiRune, _ := utf8.DecodeRune(hi)
+	if loRune == utf8.RuneError || hiRune == utf8.RuneError {
+		return false
+	}
+	for _, stack := range s.stacks {
+		if stack != nil && s.g.element(stack.pos).overlap(loRune, hiRune) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptByte return the state after b, or false when the grammar does not allow it
+func (s *grammarState) acceptByte(b byte) (*grammarState, bool) {
+	if s.next == nil {
+		s.next = new([256]*grammarState)
+	}
+	if s.next[b] == nil {
+		s.next[b] = s.advance(b)
+	}
+	next := s.next[b]
+	return next, next != rejectedState
+}
+
+func (s *grammarState) advance(b byte) *grammarState {
+	if !s.started && len(s.pending) == 0 && (b == ' ' || b == '\n') {
+		return s
+	}
+	pending := append(s.pending[:len(s.pending):len(s.pending)], b)
+	if !utf8.FullRune(pending) {
+		if !s.mayComplete(pending) {
+			return rejectedState
+		}
+		return s.g.state(append([]*grammarStack(nil), s.stacks...), pending, true)
+	}
+	r, size := utf8.DecodeRune(pending)
+	if r == utf8.RuneError && size <= 1 {
+		return rejectedState
+	}
+	stacks := s.acceptRune(r)
+	if len(stacks) == 0 {
+		return rejectedState
+	}
+	return s.g.state(stacks, nil, true)
+}
+
+func (s *grammarState) acceptText(text []byte) (*grammarState, bool) {
+	state := s
+	for _, b := range text {
+		var ok bool
+		if state, ok = state.acceptByte(b); !ok {
+			return nil, false
+		}
+	}
+	return state, true
+}
+
+// complete report whether the output so far matches the whole grammar
+func (s *grammarState) complete() bool {
+	if len(s.pending) > 0 {
+		return false
+	}
+	for _, stack := range s.stacks {
+		if stack == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// allow set allowed[id] for every token below node whose text the grammar accepts
+func (s *grammarState) allow(node *vocabNode, allowed []byte) {
+	for _, child := range node.children {
+		next, ok := s.acceptByte(child.b)
+		if !ok {
+			continue
+		}
+		for _, id := range child.node.ids {
+			allowed[id] = 1
+		}
+		next.allow(child.node, allowed)
+	}
+}
+
+// vocabulary of a model for grammar masks, texts[id] is what a token adds to the output,
+// nil for special tokens, the trie shares the work for tokens with a common prefix
+type vocabulary struct {
+	texts [][]byte
+	trie  *vocabNode
+}
+
+type vocabNode struct {
+	children []vocabEdge
+	ids      []int
+}
+
+type vocabEdge struct {
+	b    byte
+	node *vocabNode
+}
+
+func newVocabulary(texts [][]byte) *vocabulary {
+	v := &vocabulary{texts: texts, trie: &vocabNode{}}
+	for id, text := range texts {
+		// tokens which add nothing never advance the grammar
+		if len(text) == 0 {
+			continue
+		}
+		node := v.trie
+		for _, b := range text {
+			node = node.child(b)
+		}
+		node.ids = append(node.ids, id)
+	}
+	return v
+}
+
+func (n *vocabNode) child(b byte) *vocabNode {
+	for _, edge := range n.children {
+		if edge.b == b {
+			return edge.node
+		}
+	}
+	child := &vocabNode{}
+	n.children = append(n.children, vocabEdge{b, child})
+	return child
+}
@@ -0,0 +1,67 @@
+package chatglm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ChatJSON chat by history for a JSON answer which is unmarshalled into out, a non-nil pointer.
+// The schema of out, see JSONSchema, is appended to the last message and unless Grammar or beam
+// search is set the output is constrained to it. Output which does not match the schema is fed back
+// as an observation, up to JSONRetries times, before ErrInvalidJSON is returned.
+func (llm *Chatglm) ChatJSON(ctx context.Context, messages []*ChatMessage, out any, opts ...GenerationOption) error {
+	value := reflect.ValueOf(out)
+	if value.Kind() != reflect.Pointer || value.IsNil() {
+		return fmt.Errorf("%w: out must be a non-nil pointer, got %T", ErrInvalidJSON, out)
+	}
+	schema, err := JSONSchema(out)
+	if err != nil {
+		return err
+	}
+	if err := checkChatMessages(messages); err != nil {
+		return err
+	}
+
+	opt := NewGenerationOptions(opts...)
+	if opt.Grammar == "" && opt.NumBeams <= 1 {
+		opt.Grammar = schema.Grammar()
+	}
+	schemaText, err := json.Marshal(schema)
+	if err != nil {
+		return err
+	}
+
+	// leave the caller's messages alone
+	history := append([]*ChatMessage{}, messages...)
+	last := *history[len(history)-1]
+	last.Content += "\n\nAnswer only with JSON matching this JSON Schema:\n" + string(schemaText)
+	history[len(history)-1] = &last
+
+	modelType := llm.ModelType()
+	for attempt := 0; ; attempt++ {
+		result, err := llm.chat(ctx, history, opt, opt.StreamCallback != nil)
+		if err != nil {
+			return err
+		}
+		err = decodeJSON(result.Text, schema, out)
+		if err == nil || !errors.Is(err, ErrInvalidJSON) || attempt >= opt.JSONRetries {
+			return err
+		}
+
+		// result.Text is decoded from the token ids with special tokens skipped, so JSON spelling
+		// them survives, and the reply goes back as the message it was parsed into
+		feedback := "The JSON is invalid, answer again with corrected JSON. " + err.Error()
+		history = append(history, result.Message, jsonFeedbackMsg(feedback, modelType))
+	}
+}
+
+// jsonFeedbackMsg is an observation for ChatGLM3, older models have no such role
+func jsonFeedbackMsg(content string, modelType string) *ChatMessage {
+	if modelType == "ChatGLM3" {
+		return NewObservationMsg(content)
+	}
+	return NewUserMsg(content)
+}
@@ -22,6 +22,144 @@ type GenerationOptions struct {
 	RepetitionPenalty float32
 	NumThreads        int
 	StreamCallback    func(string) bool
+	// StopSequences end generation once the output contains any of them
+	StopSequences []string
+	// Seed of the sampler, the same input and seed give the same output, negative is random
+	Seed int64
+	// MinP keep tokens with at least MinP times the probability of the most likely token, 0 disables it
+	MinP float32
+	// TypicalP locally typical sampling, 1 disables it
+	TypicalP float32
+	// PresencePenalty and FrequencyPenalty follow openai, they count the last PenaltyWindow
+	// generated tokens, 0 counts all generated tokens
+	PresencePenalty  float32
+	FrequencyPenalty float32
+	PenaltyWindow    int
+	// NoRepeatNgramSize never generate an ngram of this size twice, 0 disables it
+	NoRepeatNgramSize int
+	// LogitBias is added to the logits of token ids before sampling
+	LogitBias map[int]float32
+	// BannedTokens are never sampled
+	BannedTokens []int
+	// BannedStrings never appear in the output, special tokens are matched by their text like [gMASK]
+	BannedStrings []string
+	// Logprobs report the log-probability of every generated token and this many alternatives, 0 disables it
+	Logprobs int
+	// N completions are returned, BestOf of them are generated and the N most likely are kept,
+	// BestOf 0 generates N
+	N      int
+	BestOf int
+	// NumBeams > 1 decodes with beam search instead of sampling, the beams are returned as Choices
+	// up to N, LengthPenalty > 0 favours longer beams, EarlyStopping ends as soon as NumBeams beams finished
+	NumBeams      int
+	LengthPenalty float32
+	EarlyStopping bool
+	// Grammar the output must match, GBNF or a regular expression between slashes
+	Grammar string
+	// JSONRetries how often ChatJSON asks again after output which does not match the schema
+	JSONRetries int
+	// Pooling and Normalize are used by Embed
+	Pooling   Pooling
+	Normalize bool
+
+	// tokenCallback receive printable text with its token ids, take precedence over StreamCallback
+	tokenCallback func(string, []int) bool
+}
+
+// Pooling reduces hidden states of every token into a single embedding
+type Pooling int
+
+const (
+	// PoolingMean average all tokens
+	PoolingMean Pooling = iota
+	// PoolingLast take the last token
+	PoolingLast
+	// PoolingCLS take the first token
+	PoolingCLS
+)
+
+// FinishReason tells why generation ended
+type FinishReason string
+
+const (
+	// FinishStop the model generated an eos token
+	FinishStop FinishReason = "stop"
+	// FinishLength max_length was reached
+	FinishLength FinishReason = "length"
+	// FinishCancelled the context was done
+	FinishCancelled FinishReason = "cancelled"
+	// FinishCallback the stream callback returned false
+	FinishCallback FinishReason = "callback"
+	// FinishStopSequence the output contains one of the stop sequences
+	FinishStopSequence FinishReason = "stop_sequence"
+)
+
+// Usage counts tokens of a generation
+type Usage struct {
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+}
+
+// Timings of a generation, the prompt evaluation yields the first token
+// and the completion covers the tokens after it
+type Timings struct {
+	PromptMs        float64
+	CompletionMs    float64
+	PerTokenMs      float64
+	TokensPerSecond float64
+}
+
+// Result is the generated text with its finish reason, token usage and timings
+type Result struct {
+	Text         string
+	FinishReason FinishReason
+	// StopSequence is the matched stop sequence when FinishReason is FinishStopSequence
+	StopSequence string
+	Usage        Usage
+	Timings      Timings
+	// Logprobs of every generated token when SetLogprobs is used
+	Logprobs []TokenLogprobs
+	// Choices are the completions requested by SetN, the fields above repeat the first one,
+	// Usage and Timings cover all of them
+	Choices []Choice
+	// Message is the reply of chat as NewAssistantMsg parses it, with ChatGLM3 function calls
+	// in ToolCalls, it is nil for generate
+	Message *ChatMessage
+}
+
+// Choice is one completion of a request
+type Choice struct {
+	Index        int
+	Text         string
+	FinishReason FinishReason
+	StopSequence string
+	// Logprob is the log-probability of the whole completion under the model,
+	// with beam search it is the score of the beam normalised by LengthPenalty
+	Logprob  float64
+	Logprobs []TokenLogprobs
+}
+
+// TokenLogprob is the log-probability of a token under the model before any sampler,
+// Piece is the vocabulary piece like TokenToPiece returns
+type TokenLogprob struct {
+	Id      int
+	Piece   string
+	Logprob float32
+}
+
+// ScoreResult is the log-likelihood of a text under the model, the first token has no context and is not scored,
+// tokens added by the tokenizer like [gMASK] sop are scored like text
+type ScoreResult struct {
+	Tokens        []TokenLogprob
+	LogLikelihood float64
+	Perplexity    float64
+}
+
+// TokenLogprobs of a generated token with the most likely tokens at its position
+type TokenLogprobs struct {
+	TokenLogprob
+	TopLogprobs []TokenLogprob
 }
 
 type ChatMessage struct {
@@ -54,6 +192,21 @@ var DefaultGenerationOptions GenerationOptions = GenerationOptions{
 	RepetitionPenalty: 1.0,
 	NumThreads:        0,
 	StreamCallback:    nil,
+	Pooling:           PoolingMean,
+	Normalize:         false,
+	Seed:              -1,
+	N:                 1,
+	BestOf:            0,
+	NumBeams:          1,
+	LengthPenalty:     1.0,
+	EarlyStopping:     false,
+	MinP:              0,
+	TypicalP:          1.0,
+	PresencePenalty:   0,
+	FrequencyPenalty:  0,
+	PenaltyWindow:     0,
+	NoRepeatNgramSize: 0,
+	JSONRetries:       2,
 }
 
 func NewGenerationOptions(opts ...GenerationOption) *GenerationOptions {
@@ -112,8 +265,159 @@ func SetNumThreads(numThreads int) GenerationOption {
 	}
 }
 
+// SetStreamCallback receive every printable piece of text, return false to stop generation
 func SetStreamCallback(callback func(string) bool) GenerationOption {
 	return func(g *GenerationOptions) {
 		g.StreamCallback = callback
 	}
 }
+
+func SetPooling(pooling Pooling) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.Pooling = pooling
+	}
+}
+
+func SetNormalize(normalize bool) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.Normalize = normalize
+	}
+}
+
+// SetStopSequences stop generation as soon as the output contains any of stops, the returned
+// text is cut before the stop. streamed text which may start a stop is held back until it is
+// known not to, so the streamed text never contains the stop and equals the returned text
+func SetStopSequences(stops []string) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.StopSequences = stops
+	}
+}
+
+// SetSeed make sampling reproducible, a negative seed draws a random one for every request
+func SetSeed(seed int64) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.Seed = seed
+	}
+}
+
+func SetMinP(minP float32) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.MinP = minP
+	}
+}
+
+func SetTypicalP(typicalP float32) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.TypicalP = typicalP
+	}
+}
+
+// SetPresencePenalty lower the logit of every token which already occurs in the penalty window
+func SetPresencePenalty(presencePenalty float32) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.PresencePenalty = presencePenalty
+	}
+}
+
+// SetFrequencyPenalty lower the logit of a token by its count in the penalty window
+func SetFrequencyPenalty(frequencyPenalty float32) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.FrequencyPenalty = frequencyPenalty
+	}
+}
+
+// SetPenaltyWindow count only the last window generated tokens for presence and frequency penalties
+func SetPenaltyWindow(window int) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.PenaltyWindow = window
+	}
+}
+
+func SetNoRepeatNgramSize(size int) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.NoRepeatNgramSize = size
+	}
+}
+
+// SetLogitBias add bias to the logit of each token id before sampling, a large negative bias suppresses
+// the token and a positive one boosts it
+func SetLogitBias(bias map[int]float32) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.LogitBias = bias
+	}
+}
+
+// SetBannedTokens never sample the token ids, they take precedence over SetLogitBias
+func SetBannedTokens(ids []int) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.BannedTokens = ids
+	}
+}
+
+// SetBannedStrings resample every token which would complete one of banned in the output,
+// banned strings may span several tokens
+func SetBannedStrings(banned []string) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.BannedStrings = banned
+	}
+}
+
+// SetLogprobs report the log-probability of every generated token and its n most likely alternatives in Result
+func SetLogprobs(n int) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.Logprobs = n
+	}
+}
+
+// SetN return n completions for a single prompt, the prompt is evaluated once for all of them,
+// only the first completion is streamed
+func SetN(n int) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.N = n
+	}
+}
+
+// SetBestOf generate bestOf completions and return the N with the highest log-probability, most likely first
+func SetBestOf(bestOf int) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.BestOf = bestOf
+	}
+}
+
+// SetNumBeams decode with beam search of numBeams beams, sampling options do not apply,
+// SetN(numBeams) returns all beams best first
+func SetNumBeams(numBeams int) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.NumBeams = numBeams
+	}
+}
+
+// SetLengthPenalty divide the log-probability of a beam by its length to the power of lengthPenalty
+func SetLengthPenalty(lengthPenalty float32) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.LengthPenalty = lengthPenalty
+	}
+}
+
+// SetEarlyStopping stop beam search as soon as NumBeams beams are finished
+func SetEarlyStopping(earlyStopping bool) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.EarlyStopping = earlyStopping
+	}
+}
+
+// SetGrammar constrain the output to a GBNF grammar starting at the rule root, or to a regular expression
+// written between slashes like /[0-9]+/. tokens which can not continue a match are never sampled and
+// generation only ends once the output matches. it does not apply to beam search
+func SetGrammar(grammar string) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.Grammar = grammar
+	}
+}
+
+// SetJSONRetries set how often ChatJSON feeds the validation error back and asks again
+func SetJSONRetries(retries int) GenerationOption {
+	return func(g *GenerationOptions) {
+		g.JSONRetries = retries
+	}
+}
@@ -0,0 +1,449 @@
+package chatglm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schema is the part of JSON Schema which ChatJSON and tools use
+type Schema struct {
+	Type        string             `json:"type,omitempty"`
+	Format      string             `json:"format,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Enum        []any              `json:"enum,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	// MinItems and MaxItems bound the length of an array, 0 is no bound
+	MinItems             int     `json:"minItems,omitempty"`
+	MaxItems             int     `json:"maxItems,omitempty"`
+	AdditionalProperties *Schema `json:"additionalProperties,omitempty"`
+
+	// order of Properties as the struct declares them
+	order []string
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	rawMessageType    = reflect.TypeOf(json.RawMessage{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// JSONSchema derive the schema of the type of v. struct fields are named by their json tags, fields
+// without omitempty are required, the description tag describes a field and the enum tag lists its
+// allowed values separated by commas
+func JSONSchema(v any) (*Schema, error) {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return nil, fmt.Errorf("%w: no schema for nil", ErrInvalidJSON)
+	}
+	return typeSchema(t, map[reflect.Type]bool{})
+}
+
+func typeSchema(t reflect.Type, seen map[reflect.Type]bool) (*Schema, error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}, nil
+	case t == rawMessageType || t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType):
+		// any value
+		return &Schema{}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}, nil
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}, nil
+	case reflect.String:
+		return &Schema{Type: "string"}, nil
+	case reflect.Interface:
+		return &Schema{}, nil
+	case reflect.Slice, reflect.Array:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			// []byte is base64
+			return &Schema{Type: "string"}, nil
+		}
+		items, err := typeSchema(t.Elem(), seen)
+		if err != nil {
+			return nil, err
+		}
+		schema := &Schema{Type: "array", Items: items}
+		if t.Kind() == reflect.Array {
+			schema.MinItems, schema.MaxItems = t.Len(), t.Len()
+		}
+		return schema, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("%w: map key %s is not a string", ErrInvalidJSON, t.Key())
+		}
+		values, err := typeSchema(t.Elem(), seen)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{Type: "object", AdditionalProperties: values}, nil
+	case reflect.Struct:
+		if seen[t] {
+			return nil, fmt.Errorf("%w: recursive type %s", ErrInvalidJSON, t)
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		if err := addFields(schema, t, seen); err != nil {
+			return nil, err
+		}
+		return schema, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported type %s", ErrInvalidJSON, t)
+}
+
+// addFields add the fields of struct t, embedded structs without a json name are flattened like encoding/json
+func addFields(schema *Schema, t reflect.Type, seen map[reflect.Type]bool) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			if err := addFields(schema, fieldType, seen); err != nil {
+				return err
+			}
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		property, err := typeSchema(field.Type, seen)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(","+options+",", ",string,") {
+			property = &Schema{Type: "string"}
+		}
+		property.Description = field.Tag.Get("description")
+		if enum := field.Tag.Get("enum"); enum != "" {
+			if property.Enum, err = enumValues(property.Type, strings.Split(enum, ",")); err != nil {
+				return fmt.Errorf("%w: field %s: %v", ErrInvalidJSON, field.Name, err)
+			}
+		}
+
+		if _, ok := schema.Properties[name]; !ok {
+			schema.order = append(schema.order, name)
+		}
+		schema.Properties[name] = property
+		if !strings.Contains(","+options+",", ",omitempty,") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	return nil
+}
+
+// enumValues convert the values of an enum tag into the type of the field
+func enumValues(typ string, values []string) ([]any, error) {
+	enum := make([]any, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		switch typ {
+		case "integer":
+			i, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			enum = append(enum, i)
+		case "number":
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, err
+			}
+			enum = append(enum, f)
+		case "boolean":
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, err
+			}
+			enum = append(enum, b)
+		default:
+			enum = append(enum, value)
+		}
+	}
+	return enum, nil
+}
+
+// propertyNames in declaration order, sorted when the schema did not come from a struct
+func (s *Schema) propertyNames() []string {
+	if len(s.order) == len(s.Properties) {
+		return s.order
+	}
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Schema) required(name string) bool {
+	for _, required := range s.Required {
+		if required == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate check that v, as decoded by encoding/json, matches the schema
+func (s *Schema) Validate(v any) error {
+	return s.validate(v, "$")
+}
+
+func (s *Schema) validate(v any, path string) error {
+	if s == nil {
+		return nil
+	}
+	if len(s.Enum) > 0 && !enumContains(s.Enum, v) {
+		return fmt.Errorf("%s: %s is not one of %s", path, jsonText(v), jsonText(s.Enum))
+	}
+
+	switch s.Type {
+	case "object":
+		object, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: expected an object, got %s", path, jsonText(v))
+		}
+		for _, name := range s.Required {
+			if _, ok := object[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		for name, value := range object {
+			property, ok := s.Properties[name]
+			if !ok {
+				property = s.AdditionalProperties
+			}
+			if !ok && s.AdditionalProperties == nil && s.Properties != nil {
+				return fmt.Errorf("%s: unknown property %q", path, name)
+			}
+			// optional properties may be null
+			if value == nil && !s.required(name) {
+				continue
+			}
+			if err := property.validate(value, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("%s: expected an array, got %s", path, jsonText(v))
+		}
+		if len(array) < s.MinItems || (s.MaxItems > 0 && len(array) > s.MaxItems) {
+			return fmt.Errorf("%s: expected %d to %d items, got %d", path, s.MinItems, s.MaxItems, len(array))
+		}
+		for i, item := range array {
+			if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s: expected a string, got %s", path, jsonText(v))
+		}
+	case "integer":
+		if !isInteger(v) {
+			return fmt.Errorf("%s: expected an integer, got %s", path, jsonText(v))
+		}
+	case "number":
+		if !isNumber(v) {
+			return fmt.Errorf("%s: expected a number, got %s", path, jsonText(v))
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: expected a boolean, got %s", path, jsonText(v))
+		}
+	case "null":
+		if v != nil {
+			return fmt.Errorf("%s: expected null, got %s", path, jsonText(v))
+		}
+	}
+	return nil
+}
+
+func isNumber(v any) bool {
+	switch v.(type) {
+	case json.Number, float64:
+		return true
+	}
+	return false
+}
+
+func isInteger(v any) bool {
+	switch n := v.(type) {
+	case json.Number:
+		_, ok := new(big.Int).SetString(n.String(), 10)
+		return ok
+	case float64:
+		return n == float64(int64(n))
+	}
+	return false
+}
+
+func enumContains(enum []any, v any) bool {
+	text := jsonText(v)
+	for _, value := range enum {
+		if jsonText(value) == text {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonText(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+// decodeJSON validate the JSON text against schema and unmarshal it into out
+func decodeJSON(text string, schema *Schema, out any) error {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return fmt.Errorf("%w: unexpected data after the JSON value", ErrInvalidJSON)
+	}
+	if err := schema.Validate(v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+	if err := json.Unmarshal([]byte(text), out); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+	}
+	return nil
+}
+
+// jsonGrammarRules match any JSON value
+const jsonGrammarRules = `
+value   ::= object | array | string | number | boolean | null
+object  ::= "{" ws ( string ws ":" ws value ws ( "," ws string ws ":" ws value ws )* )? "}"
+array   ::= "[" ws ( value ws ( "," ws value ws )* )? "]"
+string  ::= "\"" ( [^"\\\x00-\x1f] | "\\" ( ["\\/bfnrt] | "u" [0-9a-fA-F]{4} ) )* "\""
+number  ::= integer ( "." [0-9]+ )? ( [eE] [-+]? [0-9]+ )?
+integer ::= "-"? ( [0-9] | [1-9] [0-9]* )
+boolean ::= "true" | "false"
+null    ::= "null"
+ws      ::= [ \t\n]{0,20}
+`
+
+// Grammar return a GBNF grammar for SetGrammar of the JSON values which match the schema,
+// properties are written in order, optional properties may be null
+func (s *Schema) Grammar() string {
+	b := &schemaGrammar{}
+	root := b.value(s)
+	return "root ::= " + root + "\n" + strings.Join(b.rules, "\n") + jsonGrammarRules
+}
+
+type schemaGrammar struct {
+	rules []string
+}
+
+func (b *schemaGrammar) add(body string) string {
+	name := "schema-" + strconv.Itoa(len(b.rules)+1)
+	b.rules = append(b.rules, name+" ::= "+body)
+	return name
+}
+
+func (b *schemaGrammar) value(s *Schema) string {
+	if s == nil {
+		return "value"
+	}
+	if len(s.Enum) > 0 {
+		values := make([]string, len(s.Enum))
+		for i, value := range s.Enum {
+			values[i] = gbnfLiteral(jsonText(value))
+		}
+		return b.add(strings.Join(values, " | "))
+	}
+
+	switch s.Type {
+	case "string", "integer", "number", "boolean", "null":
+		return s.Type
+	case "array":
+		item := b.value(s.Items)
+		return b.add(`"[" ws ` + arrayItems(item, s.MinItems, s.MaxItems) + ` "]"`)
+	case "object":
+		if len(s.Properties) == 0 {
+			if s.AdditionalProperties == nil {
+				return "object"
+			}
+			value := b.value(s.AdditionalProperties)
+			return b.add(`"{" ws ( string ws ":" ws ` + value + ` ws ( "," ws string ws ":" ws ` + value + ` ws )* )? "}"`)
+		}
+		parts := []string{`"{" ws`}
+		for i, name := range s.propertyNames() {
+			value := b.value(s.Properties[name])
+			if !s.required(name) {
+				value = "( " + value + " | null )"
+			}
+			if i > 0 {
+				parts = append(parts, `"," ws`)
+			}
+			parts = append(parts, gbnfLiteral(jsonText(name))+` ws ":" ws `+value+" ws")
+		}
+		parts = append(parts, `"}"`)
+		return b.add(strings.Join(parts, " "))
+	}
+	return "value"
+}
+
+// arrayItems match minItems to maxItems comma separated items, 0 is no bound like Validate checks
+func arrayItems(item string, minItems, maxItems int) string {
+	items := item + " ws"
+	rest := `( "," ws ` + item + ` ws )`
+	switch {
+	case maxItems == 1:
+	case maxItems > 0:
+		items += " " + rest + fmt.Sprintf("{%d,%d}", max(minItems-1, 0), maxItems-1)
+	case minItems > 1:
+		items += " " + rest + fmt.Sprintf("{%d,}", minItems-1)
+	default:
+		items += " " + rest + "*"
+	}
+	if minItems == 0 {
+		return "( " + items + " )?"
+	}
+	return items
+}
+
+// gbnfLiteral quote text as a GBNF literal
+func gbnfLiteral(text string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+	return `"` + replacer.Replace(text) + `"`
+}
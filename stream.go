@@ -0,0 +1,92 @@
+package chatglm
+
+import (
+	"context"
+	"iter"
+)
+
+// StreamEvent is a piece of streamed output, the last event of a stream has Done set
+type StreamEvent struct {
+	// Text is the printable text since the previous event
+	Text string
+	// TokenIds are the ids generated since the previous event
+	TokenIds []int
+
+	// Done marks the final event, which carries FinishReason, Usage, Timings and Err of the whole call
+	Done         bool
+	FinishReason FinishReason
+	Usage        Usage
+	Timings      Timings
+	Err          error
+}
+
+// StreamChatChan chat with stream output delivered on the returned channel, which is closed after the final event.
+// StreamCallback in opts is ignored. The channel must be drained, or ctx cancelled to stop generation,
+// once ctx is done the final event may be dropped.
+func (llm *Chatglm) StreamChatChan(ctx context.Context, messages []*ChatMessage, opts ...GenerationOption) (<-chan StreamEvent, error) {
+	if ctx.Err() != nil {
+		return nil, cancelledError(ctx)
+	}
+	if err := checkChatMessages(messages); err != nil {
+		return nil, err
+	}
+
+	events := make(chan StreamEvent)
+	opt := NewGenerationOptions(opts...)
+	opt.tokenCallback = func(text string, ids []int) bool {
+		if text == "" && len(ids) == 0 {
+			return true
+		}
+		select {
+		case events <- StreamEvent{Text: text, TokenIds: ids}:
+		case <-ctx.Done():
+			// cancelCallback ends generation with ctx.Err()
+		}
+		return true
+	}
+
+	go func() {
+		defer close(events)
+
+		res, err := llm.chat(ctx, messages, opt, true)
+		final := StreamEvent{Done: true, FinishReason: res.FinishReason, Usage: res.Usage, Timings: res.Timings, Err: err}
+		select {
+		case events <- final:
+		case <-ctx.Done():
+		}
+	}()
+	return events, nil
+}
+
+// StreamChatSeq chat with stream output as an iterator of text pieces, an error is yielded last if any.
+// Breaking out of the loop stops generation.
+func (llm *Chatglm) StreamChatSeq(ctx context.Context, messages []*ChatMessage, opts ...GenerationOption) iter.Seq2[string, error] {
+	return func(yield func(string, error) bool) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		events, err := llm.StreamChatChan(ctx, messages, opts...)
+		if err != nil {
+			yield("", err)
+			return
+		}
+		for event := range events {
+			if event.Done {
+				if event.Err != nil {
+					yield("", event.Err)
+				}
+				return
+			}
+			if event.Text == "" {
+				continue
+			}
+			if !yield(event.Text, nil) {
+				return
+			}
+		}
+		// final event dropped because ctx is done
+		if ctx.Err() != nil {
+			yield("", cancelledError(ctx))
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package chatglm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// toolsPrompt starts the ChatGLM3 system prompt which lists the tools
+const toolsPrompt = "Answer the following questions as best as you can. You have access to the following tools:\n"
+
+// ToolParam is a parameter of a tool, Type is the python type ChatGLM3 is trained with like int, str or tuple[int, int]
+type ToolParam struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+	Required    bool   `json:"required"`
+}
+
+// ToolHandler run a call of a tool with the arguments the model wrote as a JSON object,
+// the returned text is sent back to the model as the observation
+type ToolHandler func(ctx context.Context, arguments string) (string, error)
+
+// Tool is a function the model may call
+type Tool struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Params      []ToolParam `json:"params"`
+	Handler     ToolHandler `json:"-"`
+
+	// schema the arguments are validated against, nil for tools without one
+	schema *Schema
+}
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// NewSchemaTool create a tool whose params are the properties of an object schema,
+// arguments which do not match the schema are rejected before handler runs
+func NewSchemaTool(name, description string, schema *Schema, handler ToolHandler) (*Tool, error) {
+	if schema == nil || schema.Type != "object" {
+		return nil, fmt.Errorf("%w: %s: the schema of the arguments must be an object", ErrInvalidTool, name)
+	}
+	// a tool without arguments still lists its params, as [] rather than null
+	tool := &Tool{Name: name, Description: description, Params: make([]ToolParam, 0, len(schema.Properties)),
+		Handler: handler, schema: schema}
+	for _, param := range schema.propertyNames() {
+		property := schema.Properties[param]
+		tool.Params = append(tool.Params, ToolParam{
+			Name:        param,
+			Description: property.Description,
+			Type:        pythonType(property),
+			Required:    schema.required(param),
+		})
+	}
+	return tool, nil
+}
+
+// NewFuncTool create a tool from fn, a func(context.Context, T) (R, error) or func(T) (R, error) where T is a struct.
+// the params are the fields of T, see JSONSchema, and the observation is R as JSON, or R itself when it is a string
+func NewFuncTool(name, description string, fn any) (*Tool, error) {
+	value := reflect.ValueOf(fn)
+	t := reflect.TypeOf(fn)
+	if t == nil || t.Kind() != reflect.Func || t.NumIn() < 1 || t.NumIn() > 2 || t.NumOut() != 2 || t.Out(1) != errorType ||
+		(t.NumIn() == 2 && t.In(0) != contextType) {
+		return nil, fmt.Errorf("%w: %s: expected func([context.Context,] T) (R, error), got %s", ErrInvalidTool, name, t)
+	}
+	argsType := t.In(t.NumIn() - 1)
+	schema, err := JSONSchema(reflect.Zero(argsType).Interface())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidTool, name, err)
+	}
+
+	handler := func(ctx context.Context, arguments string) (string, error) {
+		args := reflect.New(argsType)
+		if err := decodeJSON(arguments, schema, args.Interface()); err != nil {
+			return "", err
+		}
+		in := []reflect.Value{args.Elem()}
+		if t.NumIn() == 2 {
+			in = []reflect.Value{reflect.ValueOf(ctx), args.Elem()}
+		}
+		out := value.Call(in)
+		if err, _ := out[1].Interface().(error); err != nil {
+			return "", err
+		}
+		return observationText(out[0].Interface())
+	}
+	return NewSchemaTool(name, description, schema, handler)
+}
+
+// observationText format the result of a tool for the model
+func observationText(result any) (string, error) {
+	if text, ok := result.(string); ok {
+		return text, nil
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(result); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// pythonType name the python type of a schema like the params of the ChatGLM3 tools prompt
+func pythonType(s *Schema) string {
+	switch s.Type {
+	case "string":
+		return "str"
+	case "integer":
+		return "int"
+	case "number":
+		return "float"
+	case "boolean":
+		return "bool"
+	case "null":
+		return "None"
+	case "array":
+		item := "Any"
+		if s.Items != nil {
+			item = pythonType(s.Items)
+		}
+		if s.MinItems > 0 && s.MinItems == s.MaxItems {
+			return "tuple[" + strings.Repeat(item+", ", s.MinItems-1) + item + "]"
+		}
+		return "list[" + item + "]"
+	case "object":
+		if len(s.Properties) == 0 && s.AdditionalProperties != nil {
+			return "dict[str, " + pythonType(s.AdditionalProperties) + "]"
+		}
+		return "dict"
+	}
+	return "Any"
+}
+
+// ToolRegistry holds the tools offered to the model in registration order.
+// Register tools before sharing the registry, lookups are then safe from several goroutines
+type ToolRegistry struct {
+	tools  []*Tool
+	byName map[string]*Tool
+}
+
+func NewToolRegistry() *ToolRegistry {
+	return &ToolRegistry{byName: map[string]*Tool{}}
+}
+
+// Register add tools, names must be unique
+func (r *ToolRegistry) Register(tools ...*Tool) error {
+	for _, tool := range tools {
+		if tool == nil || !isToolName(tool.Name) || tool.Name == "interpreter" {
+			return fmt.Errorf("%w: invalid name", ErrInvalidTool)
+		}
+		if _, ok := r.byName[tool.Name]; ok {
+			return fmt.Errorf("%w: %s is already registered", ErrInvalidTool, tool.Name)
+		}
+		r.byName[tool.Name] = tool
+		r.tools = append(r.tools, tool)
+	}
+	return nil
+}
+
+// RegisterFunc register NewFuncTool(name, description, fn)
+func (r *ToolRegistry) RegisterFunc(name, description string, fn any) error {
+	tool, err := NewFuncTool(name, description, fn)
+	if err != nil {
+		return err
+	}
+	return r.Register(tool)
+}
+
+// Tool return the tool registered as name
+func (r *ToolRegistry) Tool(name string) (*Tool, bool) {
+	tool, ok := r.byName[name]
+	return tool, ok
+}
+
+// Tools return the registered tools in registration order
+func (r *ToolRegistry) Tools() []*Tool {
+	return append([]*Tool{}, r.tools...)
+}
+
+// SystemPrompt render the ChatGLM3 system prompt listing the tools,
+// in the format of examples/system/function_call.txt
+func (r *ToolRegistry) SystemPrompt() string {
+	var prompt strings.Builder
+	prompt.WriteString(toolsPrompt)
+	prompt.WriteString("{")
+	for i, tool := range r.tools {
+		if i > 0 {
+			prompt.WriteString(",")
+		}
+		name, _ := json.Marshal(tool.Name)
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("    ", "    ")
+		// a Tool always encodes
+		_ = encoder.Encode(tool)
+		prompt.WriteString("\n    " + string(name) + ": " + strings.TrimSuffix(buf.String(), "\n"))
+	}
+	prompt.WriteString("\n}")
+	return prompt.String()
+}
+
+// SystemMsg return the system message with SystemPrompt
+func (r *ToolRegistry) SystemMsg() *ChatMessage {
+	return NewSystemMsg(r.SystemPrompt())
+}
+
+// Call run the handler of the function the model called
+func (r *ToolRegistry) Call(ctx context.Context, function *FunctionMessage) (string, error) {
+	tool, ok := r.byName[function.Name]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownTool, function.Name)
+	}
+	if tool.Handler == nil {
+		return "", fmt.Errorf("%w: %s has no handler", ErrInvalidTool, tool.Name)
+	}
+	arguments := function.Arguments
+	if strings.TrimSpace(arguments) == "" {
+		arguments = "{}"
+	}
+	if tool.schema != nil {
+		var args any
+		if err := decodeJSON(arguments, tool.schema, &args); err != nil {
+			return "", err
+		}
+	}
+	return tool.Handler(ctx, arguments)
+}
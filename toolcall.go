@@ -0,0 +1,315 @@
+package chatglm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// parseToolCallMessage parse the ChatGLM3 tool call body starts with, the tool name on the first line
+// followed by the code. the interpreter is a TypeCode call of body, any other tool a TypeFunction call,
+// see parseFunctionCall. it returns nil when body is no tool call
+func parseToolCallMessage(body string) *ToolCallMessage {
+	name, _, ok := strings.Cut(strings.TrimSpace(body), "\n")
+	if ok && strings.TrimSpace(name) == "interpreter" {
+		return &ToolCallMessage{Type: TypeCode, Code: &CodeMessage{Input: body}}
+	}
+	if function := parseFunctionCall(body); function != nil {
+		return &ToolCallMessage{Type: TypeFunction, Function: function}
+	}
+	return nil
+}
+
+// parseFunctionCall parse a ChatGLM3 function call, the tool name on the first line followed by
+//
+//	```python
+//	tool_call(seed=42, range=(0, 100))
+//	```
+//
+// the keyword arguments are converted to a JSON object, tuples become arrays. it returns nil when
+// body is not a function call, the code interpreter is not a function
+func parseFunctionCall(body string) *FunctionMessage {
+	name, code, ok := strings.Cut(strings.TrimSpace(body), "\n")
+	name = strings.TrimSpace(name)
+	if !ok || name == "interpreter" || !isToolName(name) {
+		return nil
+	}
+
+	code = strings.TrimSpace(code)
+	if !strings.HasPrefix(code, "```") || !strings.HasSuffix(code, "```") {
+		return nil
+	}
+	// drop the fence with its language
+	_, code, _ = strings.Cut(code, "\n")
+	code = strings.TrimSuffix(code, "```")
+
+	arguments, err := parseToolCall(code)
+	if err != nil {
+		return nil
+	}
+	return &FunctionMessage{Name: name, Arguments: arguments}
+}
+
+func isToolName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || (!unicode.IsDigit(r) && r != '-' && r != '.')) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseToolCall convert tool_call(k=v, ...) into a JSON object keeping the argument order
+func parseToolCall(code string) (string, error) {
+	p := &pythonParser{src: code}
+	if p.identifier() != "tool_call" || !p.consume('(') {
+		return "", fmt.Errorf("expected tool_call( at %d", p.pos)
+	}
+
+	var out bytes.Buffer
+	out.WriteByte('{')
+	seen := map[string]bool{}
+	for !p.consume(')') {
+		if len(seen) > 0 && !p.consume(',') {
+			return "", fmt.Errorf("expected , at %d", p.pos)
+		}
+		if p.consume(')') {
+			// trailing comma
+			break
+		}
+		name := p.identifier()
+		if name == "" || !p.consume('=') {
+			return "", fmt.Errorf("expected a keyword argument at %d", p.pos)
+		}
+		if seen[name] {
+			return "", fmt.Errorf("repeated keyword argument %s", name)
+		}
+		value, err := p.value()
+		if err != nil {
+			return "", err
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		if len(seen) > 0 {
+			out.WriteByte(',')
+		}
+		seen[name] = true
+		key, _ := json.Marshal(name)
+		out.Write(key)
+		out.WriteByte(':')
+		out.Write(data)
+	}
+	out.WriteByte('}')
+
+	p.space()
+	if p.pos != len(p.src) {
+		return "", fmt.Errorf("unexpected %q after tool_call", p.src[p.pos:])
+	}
+	return out.String(), nil
+}
+
+// pythonParser read python literals, the values ChatGLM3 writes as tool arguments
+type pythonParser struct {
+	src string
+	pos int
+}
+
+func (p *pythonParser) space() {
+	for p.pos < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// consume skip spaces and c when it is next
+func (p *pythonParser) consume(c byte) bool {
+	p.space()
+	if p.pos < len(p.src) && p.src[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *pythonParser) identifier() string {
+	p.space()
+	start := p.pos
+	for p.pos < len(p.src) {
+		r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+		if r != '_' && !unicode.IsLetter(r) && (p.pos == start || !unicode.IsDigit(r)) {
+			break
+		}
+		p.pos += size
+	}
+	return p.src[start:p.pos]
+}
+
+// value parse a literal into the value encoding/json marshals the same way
+func (p *pythonParser) value() (any, error) {
+	p.space()
+	if p.pos >= len(p.src) {
+		return nil, fmt.Errorf("unexpected end of tool_call")
+	}
+	switch c := p.src[p.pos]; {
+	case c == '\'' || c == '"':
+		return p.str()
+	case c == '[':
+		p.pos++
+		return p.sequence(']')
+	case c == '(':
+		p.pos++
+		return p.sequence(')')
+	case c == '{':
+		p.pos++
+		return p.dict()
+	case c == '-' || c == '+' || c == '.' || (c >= '0' && c <= '9'):
+		return p.number()
+	}
+
+	start := p.pos
+	switch p.identifier() {
+	case "True":
+		return true, nil
+	case "False":
+		return false, nil
+	case "None":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported value at %d", start)
+}
+
+// sequence parse the items of a list or tuple up to end
+func (p *pythonParser) sequence(end byte) (any, error) {
+	items := []any{}
+	for !p.consume(end) {
+		if len(items) > 0 && !p.consume(',') {
+			return nil, fmt.Errorf("expected , at %d", p.pos)
+		}
+		if p.consume(end) {
+			break
+		}
+		item, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (p *pythonParser) dict() (any, error) {
+	dict := map[string]any{}
+	for first := true; !p.consume('}'); first = false {
+		if !first && !p.consume(',') {
+			return nil, fmt.Errorf("expected , at %d", p.pos)
+		}
+		if p.consume('}') {
+			break
+		}
+		key, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			name = jsonText(key)
+		}
+		if !p.consume(':') {
+			return nil, fmt.Errorf("expected : at %d", p.pos)
+		}
+		if dict[name], err = p.value(); err != nil {
+			return nil, err
+		}
+	}
+	return dict, nil
+}
+
+func (p *pythonParser) number() (any, error) {
+	start := p.pos
+	if p.src[p.pos] == '-' || p.src[p.pos] == '+' {
+		p.pos++
+	}
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if (c < '0' || c > '9') && c != '.' && c != '_' && c != 'e' && c != 'E' &&
+			!((c == '-' || c == '+') && (p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E')) {
+			break
+		}
+		p.pos++
+	}
+	text := strings.TrimPrefix(strings.ReplaceAll(p.src[start:p.pos], "_", ""), "+")
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return i, nil
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %q", p.src[start:p.pos])
+	}
+	return f, nil
+}
+
+// str parse a quoted string with python escapes, adjacent strings are concatenated
+func (p *pythonParser) str() (any, error) {
+	var out strings.Builder
+	for p.pos < len(p.src) && (p.src[p.pos] == '\'' || p.src[p.pos] == '"') {
+		quote := p.src[p.pos]
+		p.pos++
+		for {
+			if p.pos >= len(p.src) || p.src[p.pos] == '\n' {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			c := p.src[p.pos]
+			if c == quote {
+				p.pos++
+				break
+			}
+			if c != '\\' {
+				out.WriteByte(c)
+				p.pos++
+				continue
+			}
+			if p.pos+1 >= len(p.src) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			p.pos += 2
+			switch e := p.src[p.pos-1]; e {
+			case 'n':
+				out.WriteByte('\n')
+			case 't':
+				out.WriteByte('\t')
+			case 'r':
+				out.WriteByte('\r')
+			case '0':
+				out.WriteByte(0)
+			case 'x', 'u', 'U':
+				size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[e]
+				if p.pos+size > len(p.src) {
+					return nil, fmt.Errorf("invalid escape")
+				}
+				code, err := strconv.ParseUint(p.src[p.pos:p.pos+size], 16, 32)
+				if err != nil {
+					return nil, fmt.Errorf("invalid escape")
+				}
+				out.WriteRune(rune(code))
+				p.pos += size
+			case '\n':
+				// line continuation
+			default:
+				if e != '\\' && e != '\'' && e != '"' {
+					out.WriteByte('\\')
+				}
+				out.WriteByte(e)
+			}
+		}
+		p.space()
+	}
+	return out.String(), nil
+}